@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+point-in-time recovery
+if archive_path is set, the wal is copied to <archive_path>/wal/<time of its first record>.wal before it's truncated,
+and every archive_snapshot_interval seconds a snapshot of every database is taken into <archive_path>/snapshots/<time>/ (a backup, see backup.go)
+fuqldb --restore --until "<RFC3339 timestamp>" loads the newest snapshot from before then and replays the archived (and current) wal up to then
+the newest archive_snapshots snapshots are kept, along with the wal archives they need
+*/
+
+const defaultArchiveSnapshotInterval = time.Hour
+
+const defaultArchiveSnapshots = 24
+
+// when the last archive snapshot was started
+var lastArchiveSnapshot time.Time
+
+func archivePath() string {
+	path, _ := config["archive_path"].(string)
+	return path
+}
+
+func archiveSnapshotInterval() time.Duration {
+	if seconds, ok := config["archive_snapshot_interval"].(int64); ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultArchiveSnapshotInterval
+}
+
+func archiveSnapshots() int {
+	if count, ok := config["archive_snapshots"].(int64); ok && count > 0 {
+		return int(count)
+	}
+	return defaultArchiveSnapshots
+}
+
+func archiveName(t int64) string {
+	return fmt.Sprintf("%020d", t)
+}
+
+// archiveWAL copies the wal into the archive, it's called right before the wal is truncated
+func archiveWAL(path string) error {
+	mutations, err := readWAL(path)
+	if err != nil {
+		return err
+	}
+	return archiveMutations(mutations)
+}
+
+// archiveMutations writes mutations to the archive as one wal, named after the time of the first one
+func archiveMutations(mutations []mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	dir := filepath.Join(archivePath(), "wal")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	out := walHeader()
+	for _, m := range mutations {
+		out = append(out, encodeMutation(m)...)
+	}
+	return writeFileAtomic(filepath.Join(dir, archiveName(mutations[0].Time)+".wal"), 0, func(w *bufio.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
+
+// archiveSnapshot takes a snapshot of every database into the archive if it's time for one
+func archiveSnapshot() {
+	if archivePath() == "" || time.Since(lastArchiveSnapshot) < archiveSnapshotInterval() {
+		return
+	}
+	lastArchiveSnapshot = time.Now()
+	m, snapshots, err := snapshotDatabases("")
+	if err != nil {
+		fmt.Println("WARNING: error taking archive snapshot: ", err)
+		return
+	}
+	dir := filepath.Join(archivePath(), "snapshots", archiveName(m.Time))
+	go func() {
+		if err := writeBackup(dir, m, snapshots); err != nil {
+			fmt.Println("WARNING: error writing archive snapshot: ", err)
+			return
+		}
+		if err := pruneArchive(); err != nil {
+			fmt.Println("WARNING: error pruning archive: ", err)
+		}
+	}()
+}
+
+// archivedSnapshots returns the finished snapshots in the archive, oldest first
+func archivedSnapshots() ([]backupManifest, []string, error) {
+	dir := filepath.Join(archivePath(), "snapshots")
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifests []backupManifest
+	var paths []string
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		m, err := readBackupManifest(filepath.Join(path, backupManifestName))
+		if err != nil {
+			continue
+		}
+		manifests = append(manifests, m)
+		paths = append(paths, path)
+	}
+	return manifests, paths, nil
+}
+
+// archivedWALs returns the wal archives, oldest first
+func archivedWALs() ([]string, error) {
+	dir := filepath.Join(archivePath(), "wal")
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".wal") {
+			paths = append(paths, filepath.Join(dir, file.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// pruneArchive removes all but the newest snapshots, and every wal archive that ends before the oldest one left
+func pruneArchive() error {
+	manifests, paths, err := archivedSnapshots()
+	if err != nil || len(manifests) <= archiveSnapshots() {
+		return err
+	}
+	drop := len(manifests) - archiveSnapshots()
+	for _, path := range paths[:drop] {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	oldest := archiveName(manifests[drop].Time) + ".wal"
+	wals, err := archivedWALs()
+	if err != nil {
+		return err
+	}
+	// a wal archive ends where the next one starts
+	for i := 0; i+1 < len(wals) && filepath.Base(wals[i+1]) <= oldest; i++ {
+		if err := os.Remove(wals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreUntil puts every database back the way it was at until
+func restoreUntil(until time.Time) error {
+	if archivePath() == "" {
+		return errors.New("archive_path isn't set in the config")
+	}
+	manifests, paths, err := archivedSnapshots()
+	if err != nil {
+		return err
+	}
+	base := -1
+	for i, m := range manifests {
+		if m.Time <= until.UnixNano() {
+			base = i
+		}
+	}
+	if base == -1 {
+		return fmt.Errorf("no archived snapshot from before %s", until.Format(time.RFC3339Nano))
+	}
+	fmt.Println("starting from the snapshot in", paths[base])
+	dbs = nil
+	for _, name := range manifests[base].Databases {
+		db, err := loadDB(filepath.Join(paths[base], name+".db"))
+		if err != nil {
+			return fmt.Errorf("database %s: %v", name, err)
+		}
+		db.Name = name
+		dbs = append(dbs, db)
+	}
+
+	mutations, err := archivedMutations(manifests[base].Time, until.UnixNano())
+	if err != nil {
+		return err
+	}
+	for _, m := range mutations {
+		if err := applyMutationWith(m, false); err != nil {
+			fmt.Println("WARNING: could not replay archived wal record: ", err)
+		}
+	}
+	fmt.Printf("replayed %d mutations\n", len(mutations))
+
+	// databases that didn't exist yet go away
+	keep := make(map[string]bool)
+	for _, db := range dbs {
+		keep[db.Name] = true
+	}
+	names, err := databaseNames(config["database_storage_path"].(string))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if keep[name] {
+			continue
+		}
+		dir, err := databaseDir(name)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := removeSnapshots(name); err != nil {
+			return err
+		}
+		fmt.Println("removed database", name)
+	}
+	for _, db := range dbs {
+		if err := restoreDatabase(db); err != nil {
+			return fmt.Errorf("database %s: %v", db.Name, err)
+		}
+		fmt.Println("restored database", db.Name)
+	}
+	// everything in the wal is either restored or after until, it's still in the archive if it's needed again
+	if err := archiveWAL(walPathFromConfig()); err != nil {
+		return err
+	}
+	return writeFileAtomic(walPathFromConfig(), 0, func(w *bufio.Writer) error {
+		_, err := w.Write(walHeader())
+		return err
+	})
+}
+
+// archivedRecord is what tells two copies of a mutation apart, their encoded records differ once they're sealed with a random nonce
+type archivedRecord struct {
+	time     int64
+	sequence uint64
+	op       walOp
+	database string
+	table    string
+	key      string
+}
+
+// archivedMutations returns every archived mutation plus whatever is in the wal right now from after until up to until, once each, oldest first
+func archivedMutations(after int64, until int64) ([]mutation, error) {
+	walPaths, err := archivedWALs()
+	if err != nil {
+		return nil, err
+	}
+	walPaths = append(walPaths, walPathFromConfig())
+	var mutations []mutation
+	seen := make(map[archivedRecord]bool)
+	for _, path := range walPaths {
+		logged, err := readWAL(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, m := range logged {
+			if m.Time <= after || m.Time > until {
+				continue
+			}
+			record := archivedRecord{time: m.Time, sequence: m.Sequence, op: m.Op, database: m.Database, table: m.Table}
+			if m.Key != nil {
+				record.key = formatLiteral(m.Key)
+			}
+			if !seen[record] {
+				seen[record] = true
+				mutations = append(mutations, m)
+			}
+		}
+	}
+	sort.SliceStable(mutations, func(i, j int) bool { return mutations[i].Time < mutations[j].Time })
+	return mutations, nil
+}
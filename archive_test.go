@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// takeArchiveSnapshot does what archiveSnapshot does, without waiting for the interval or writing in the background
+func takeArchiveSnapshot(t *testing.T) time.Time {
+	t.Helper()
+	m, snapshots, err := snapshotDatabases("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBackup(filepath.Join(archivePath(), "snapshots", archiveName(m.Time)), m, snapshots); err != nil {
+		t.Fatal(err)
+	}
+	return time.Unix(0, m.Time)
+}
+
+// restoring to a point in time starts from the snapshot before it and replays both the archived and the current wal up to it
+func TestRestoreUntil(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			config["archive_path"] = t.TempDir()
+			runCommand(t, ctx, `tell entry to create a,1`)
+			runCommand(t, ctx, `tell entry to create b,2`)
+			snapshot := takeArchiveSnapshot(t)
+
+			runCommand(t, ctx, `tell entry to become a,3`)
+			afterA := time.Now()
+			runCommand(t, ctx, `tell entry to create c,4`)
+			afterC := time.Now()
+			// the wal up to here is only in the archive now
+			saveDatabases(true)
+
+			runCommand(t, ctx, `tell entry to become a,5`)
+			runCommand(t, ctx, `tell entry to fuck off b`)
+			if err := commitMutation(mutation{Op: walOpCreateDatabase, Database: "later"}); err != nil {
+				t.Fatal(err)
+			}
+			afterAll := time.Now()
+
+			for _, point := range []struct {
+				until   time.Time
+				a, b, c string
+				later   bool
+			}{
+				{snapshot, "1", "2", "null", false},
+				{afterA, "3", "2", "null", false},
+				{afterC, "3", "2", "4", false},
+				{afterAll, "5", "null", "4", true},
+				// the wal isn't lost by restoring to an earlier time, it's in the archive
+				{afterC, "3", "2", "4", false},
+			} {
+				stopTestServer()
+				if err := restoreUntil(point.until); err != nil {
+					t.Fatal(err)
+				}
+				ctx = crashTestServer(t)
+				for key, want := range map[string]string{"a": point.a, "b": point.b, "c": point.c} {
+					if got := runCommand(t, ctx, `tell entry to present `+key); got != want {
+						t.Errorf("restored to %s, %s is %s, want %s", point.until.Format(time.RFC3339Nano), key, got, want)
+					}
+				}
+				if (findDatabase("later") != nil) != point.later {
+					t.Errorf("restored to %s, database later exists: %v", point.until.Format(time.RFC3339Nano), !point.later)
+				}
+			}
+
+			stopTestServer()
+			if err := restoreUntil(snapshot.Add(-time.Nanosecond)); err == nil {
+				t.Fatal("restored to before the oldest snapshot")
+			}
+		})
+	}
+}
+
+// a mutation that's in both the archive and the wal is replayed once, even though its two records were sealed with different nonces
+func TestRestoreUntilEncrypted(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	config["archive_path"] = t.TempDir()
+	useKeys(t, oldTestKey)
+	runCommand(t, ctx, `tell entry to create a,1`)
+	snapshot := takeArchiveSnapshot(t)
+	runCommand(t, ctx, `tell entry to become a,2`)
+	runCommand(t, ctx, `tell entry to create b,3`)
+	// like a crash after archiving the wal but before truncating it
+	if err := archiveWAL(walPathFromConfig()); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	mutations, err := archivedMutations(snapshot.UnixNano(), now.UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutations) != 2 {
+		t.Fatalf("%d mutations to replay, want the 2 since the snapshot once each", len(mutations))
+	}
+
+	stopTestServer()
+	if err := restoreUntil(now); err != nil {
+		t.Fatal(err)
+	}
+	ctx = crashTestServer(t)
+	for key, want := range map[string]string{"a": "2", "b": "3"} {
+		if got := runCommand(t, ctx, `tell entry to present `+key); got != want {
+			t.Errorf("%s is %s after restoring, want %s", key, got, want)
+		}
+	}
+	if found := storedPlainly(t, "FUQLDB"); len(found) > 0 {
+		t.Errorf("restoring wrote %v unencrypted", found)
+	}
+}
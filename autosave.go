@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+autosave
+every database keeps track of how many changes it has that aren't on disk yet,
+only those with changes get saved, at most once every autosave_interval seconds
+*/
+
+const defaultAutoSaveInterval = 60 * time.Second
+
+// databases that were deleted but still have files on disk
+var deletedDatabases []string
+
+// storageLock is held while databases are saved, and by a key rotation while it rewrites a file
+var storageLock sync.Mutex
+
+func autoSaveInterval() time.Duration {
+	if seconds, ok := config["autosave_interval"].(int64); ok && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultAutoSaveInterval
+}
+
+func (db *Database) markDirty() {
+	db.pendingChanges++
+}
+
+func (db *Database) dirty() bool {
+	return db.pendingChanges > 0
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(config["database_storage_path"].(string), name+".db")
+}
+
+// removeSnapshots deletes every generation of a database's old single file snapshot
+func removeSnapshots(name string) error {
+	path := snapshotPath(name)
+	for generation := 0; generation <= snapshotGenerations(); generation++ {
+		err := os.Remove(generationPath(path, generation))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetDeletedDatabase removes a deleted database's files right away, instead of on the next save
+func forgetDeletedDatabase(name string) error {
+	for i, deleted := range deletedDatabases {
+		if deleted != name {
+			continue
+		}
+		dir, err := databaseDir(name)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := removeSnapshots(name); err != nil {
+			return err
+		}
+		deletedDatabases = append(deletedDatabases[:i], deletedDatabases[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+// saveDatabases saves every database with changes that hasn't been saved for an autosave interval
+// if force is true, every database with changes is saved right away
+// once nothing is left unsaved, the wal is truncated, until then only records every database has saved are dropped
+func saveDatabases(force bool) {
+	storageLock.Lock()
+	defer storageLock.Unlock()
+	var stillDeleted []string
+	for _, name := range deletedDatabases {
+		// a database created again under the same name already took itself off the list
+		dir, err := databaseDir(name)
+		if err == nil {
+			err = os.RemoveAll(dir)
+		}
+		if err == nil {
+			err = removeSnapshots(name)
+		}
+		if err != nil {
+			fmt.Println("WARNING: error removing deleted database: ", err)
+			stillDeleted = append(stillDeleted, name)
+		}
+	}
+	deletedDatabases = stillDeleted
+
+	allSaved := len(deletedDatabases) == 0
+	savedAny := false
+	for i := range dbs {
+		db := &dbs[i]
+		if !db.dirty() {
+			// mutations that failed didn't change anything, so there's nothing newer to save
+			db.appliedUntil = db.lastMutation
+			continue
+		}
+		if !force && time.Since(db.lastSave) < autoSaveInterval() {
+			allSaved = false
+			continue
+		}
+		if db.engine != nil {
+			if err := db.engine.snapshot(db); err != nil {
+				fmt.Println("WARNING: error saving database: ", err)
+				allSaved = false
+				continue
+			}
+		}
+		db.pendingChanges = 0
+		db.lastSave = time.Now()
+		db.appliedUntil = db.lastMutation
+		savedAny = true
+	}
+	if wal == nil {
+		return
+	}
+	// everything in the wal is now in the snapshots
+	if allSaved {
+		if err := wal.truncate(); err != nil {
+			fmt.Println("WARNING: error truncating wal: ", err)
+		}
+	} else if savedAny {
+		if err := wal.dropSaved(); err != nil {
+			fmt.Println("WARNING: error dropping saved records from the wal: ", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// saving one database while another one still has changes used to replay the saved changes again after a crash
+func TestCrashAfterPartialSave(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			config["autosave_interval"] = int64(3600)
+			runCommand(t, ctx, `tell list to push back l 1`)
+			runCommand(t, ctx, `tell list to push back l 2`)
+			// app is due for a save, users isn't, so the wal can't be truncated
+			findDatabase("app").lastSave = time.Time{}
+			findDatabase("users").lastSave = time.Now()
+			saveDatabases(false)
+			if findDatabase("app").dirty() || !findDatabase("users").dirty() {
+				t.Fatal("only app should have been saved")
+			}
+
+			ctx = crashTestServer(t)
+			if got := runCommand(t, ctx, `tell entry to present l`); got != "[1,2]" {
+				t.Fatalf("l is %s after the crash, want [1,2]", got)
+			}
+			if got := runCommand(t, ctx, `tell entry to present version l`); got != "2" {
+				t.Fatalf("l is at version %s after the crash, want 2", got)
+			}
+		})
+	}
+}
+
+// records a database has saved are dropped from the wal even when another database still has changes
+func TestPartialSaveShrinksWAL(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	config["autosave_interval"] = int64(3600)
+	saveDatabases(true)
+	runCommand(t, ctx, `tell entry to create a,1`)
+	if err := commitMutation(mutation{Op: walOpCreateTable, Database: "users", Table: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	findDatabase("app").lastSave = time.Time{}
+	findDatabase("users").lastSave = time.Now()
+	saveDatabases(false)
+
+	mutations, err := readWAL(walPathFromConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutations) != 1 || mutations[0].Database != "users" {
+		t.Fatalf("wal has %d records after app was saved, want only the one for users", len(mutations))
+	}
+	ctx = crashTestServer(t)
+	if got := runCommand(t, ctx, `tell entry to present a`); got != "1" {
+		t.Fatalf("a is %s after the crash, want 1", got)
+	}
+	if findDatabase("users").getTable("other") == nil {
+		t.Fatal("users lost the table that was only in the wal")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+online backups
+tell database to backup [name] to "<dir>" copies one database (or all of them) into dir as <name>.db files (format.go)
+the copy is taken between two demands so it's consistent, writing it out happens in the background so clients can keep going
+BACKUP is written last and lists what's in the backup, a directory without it is an unfinished backup
+fuqldb --restore <dir> puts every database in a backup back, the server must not be running
+BACKUP: "FUQLBAK" | version (uint16) | crc32 of the above | section (see format.go) with time (uint64) | count (uint32) | names
+*/
+
+const backupMagic = "FUQLBAK"
+
+const backupVersion uint16 = 1
+
+const backupManifestName = "BACKUP"
+
+type backupManifest struct {
+	Time      int64
+	Databases []string
+}
+
+func encodeBackupManifest(m backupManifest) []byte {
+	header := appendUint16([]byte(backupMagic), backupVersion)
+	out := appendUint32(header, crc32.ChecksumIEEE(header))
+	payload := appendUint64(nil, uint64(m.Time))
+	payload = appendUint32(payload, uint32(len(m.Databases)))
+	for _, name := range m.Databases {
+		payload = appendString(payload, name)
+	}
+	return appendSection(out, payload)
+}
+
+func readBackupManifest(path string) (backupManifest, error) {
+	var m backupManifest
+	data, err := readSealedFile(path)
+	if err != nil {
+		return m, err
+	}
+	headerLength := len(backupMagic) + 2
+	if len(data) < headerLength+4 || !bytes.HasPrefix(data, []byte(backupMagic)) {
+		return m, errors.New("not a backup manifest")
+	}
+	if crc32.ChecksumIEEE(data[:headerLength]) != binary.BigEndian.Uint32(data[headerLength:]) {
+		return m, errors.New("backup manifest header checksum mismatch")
+	}
+	if version := binary.BigEndian.Uint16(data[len(backupMagic):]); version == 0 || version > backupVersion {
+		return m, fmt.Errorf("unsupported backup version %d", version)
+	}
+	payload, _, err := readSection(data[headerLength+4:])
+	if err != nil {
+		return m, err
+	}
+	var t uint64
+	if t, payload, err = readUint64(payload); err != nil {
+		return m, err
+	}
+	m.Time = int64(t)
+	count, payload, err := readUint32(payload)
+	if err != nil {
+		return m, err
+	}
+	for i := uint32(0); i < count; i++ {
+		var name string
+		if name, payload, err = readString(payload); err != nil {
+			return m, err
+		}
+		m.Databases = append(m.Databases, name)
+	}
+	return m, nil
+}
+
+func (ctx *Context) backup(name string, dir string) error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	if dir == "" {
+		return errors.New("no backup directory given")
+	}
+	m, snapshots, err := snapshotDatabases(name)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := writeBackup(dir, m, snapshots); err != nil {
+			fmt.Printf("WARNING: backup to %s failed: %v\n", dir, err)
+			return
+		}
+		fmt.Printf("backup to %s finished\n", dir)
+	}()
+	return nil
+}
+
+// snapshotDatabases encodes one database (or all of them if name is empty) as they are right now
+// every mutation committed before the manifest's time is in it, nothing after
+func snapshotDatabases(name string) (backupManifest, [][]byte, error) {
+	m := backupManifest{Time: time.Now().UnixNano()}
+	var snapshots [][]byte
+	for i := range dbs {
+		db := &dbs[i]
+		if name != "" && db.Name != name {
+			continue
+		}
+		// every table has to be in memory, the files on disk may be older or in the middle of being written
+		for j := range db.Tables {
+			if err := db.Tables[j].load(); err != nil {
+				return m, nil, err
+			}
+		}
+		m.Databases = append(m.Databases, db.Name)
+		snapshots = append(snapshots, serializeDB(*db))
+	}
+	if name != "" && len(m.Databases) == 0 {
+		return m, nil, errors.New("database not found")
+	}
+	return m, snapshots, nil
+}
+
+// writeBackup writes the snapshots of a backup, then its manifest
+func writeBackup(dir string, m backupManifest, snapshots [][]byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// an older backup in the same place isn't finished anymore once we start overwriting it
+	if err := os.Remove(filepath.Join(dir, backupManifestName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i, name := range m.Databases {
+		err := writeFileAtomic(filepath.Join(dir, name+".db"), 0, func(w *bufio.Writer) error {
+			compressed, err := compressSnapshot(snapshots[i])
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(sealFile(compressed))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(dir, backupManifestName), 0, func(w *bufio.Writer) error {
+		_, err := w.Write(sealFile(encodeBackupManifest(m)))
+		return err
+	})
+}
+
+// restoreBackup replaces every database in the backup with its copy from the backup
+// anything in the wal for those databases is thrown away, it happened after the backup was taken
+func restoreBackup(dir string) error {
+	m, err := readBackupManifest(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return fmt.Errorf("%s is not a finished backup: %v", dir, err)
+	}
+	restored := make(map[string]bool)
+	for _, name := range m.Databases {
+		db, err := loadDB(filepath.Join(dir, name+".db"))
+		if err != nil {
+			return fmt.Errorf("database %s: %v", name, err)
+		}
+		db.Name = name
+		if err := restoreDatabase(db); err != nil {
+			return fmt.Errorf("database %s: %v", name, err)
+		}
+		restored[name] = true
+		fmt.Println("restored database", name)
+	}
+	return dropWALRecords(walPathFromConfig(), restored)
+}
+
+// restoreDatabase writes db into the storage path with its configured engine, replacing whatever is there
+func restoreDatabase(db Database) error {
+	dir, err := databaseDir(db.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := removeSnapshots(db.Name); err != nil {
+		return err
+	}
+	engineName := configuredEngine(db.Name)
+	if engineName == "memory" {
+		fmt.Printf("WARNING: database %s uses the memory engine, it won't be kept\n", db.Name)
+	}
+	engine, err := newStorageEngine(engineName)
+	if err != nil {
+		return err
+	}
+	if err := engine.open(dir); err != nil {
+		return err
+	}
+	// hand the engine everything as if it was just created, then let it write a snapshot
+	now := time.Now().UnixNano()
+	for _, table := range db.Tables {
+		created := mutation{Op: walOpCreateTable, Time: now, Database: db.Name, Table: table.Name}
+		if table.schema != nil {
+			created.Value = formatSchema(table.schema)
+		}
+		mutations := []mutation{created}
+		for _, entry := range table.entries() {
+			added := mutation{Op: walOpAddEntry, Time: now, Database: db.Name, Table: table.Name, Key: entry.Key, Value: entry.Value,
+				Version: entry.version, Created: entry.created, User: entry.writer, Expires: entry.expires}
+			// the time of the add is when the entry last changed
+			if entry.updated != 0 {
+				added.Time = entry.updated
+			}
+			mutations = append(mutations, added)
+		}
+		if table.values != nil {
+			mutations = append(mutations, mutation{Op: walOpIndexValues, Time: now, Database: db.Name, Table: table.Name})
+		}
+		for _, m := range mutations {
+			if err := engine.apply(m); err != nil {
+				engine.close()
+				return err
+			}
+		}
+	}
+	if err := engine.snapshot(&db); err != nil {
+		engine.close()
+		return err
+	}
+	return engine.close()
+}
+
+// dropWALRecords rewrites the wal without any record for the given databases
+func dropWALRecords(path string, databases map[string]bool) error {
+	mutations, err := readWAL(path)
+	if err != nil || len(mutations) == 0 {
+		return err
+	}
+	out := walHeader()
+	for _, m := range mutations {
+		if !databases[m.Database] {
+			out = append(out, encodeMutation(m)...)
+		}
+	}
+	return writeFileAtomic(path, 0, func(w *bufio.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForBackup waits for the background half of a backup to write its manifest
+func waitForBackup(t *testing.T, dir string) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if _, err := readBackupManifest(filepath.Join(dir, backupManifestName)); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the backup never finished")
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			runCommand(t, ctx, `tell entry to create a,1`)
+			runCommand(t, ctx, `tell entry to create b,"two"`)
+			runCommand(t, ctx, `tell table to index value`)
+			saveDatabases(true)
+			runCommand(t, ctx, `tell entry to create c,3`)
+			dir := filepath.Join(t.TempDir(), "backup")
+			runCommand(t, ctx, `tell database to backup app to "`+dir+`"`)
+			waitForBackup(t, dir)
+
+			// changes after the backup, some saved and some only in the wal
+			runCommand(t, ctx, `tell entry to become a,10`)
+			runCommand(t, ctx, `tell entry to fuck off b`)
+			saveDatabases(true)
+			runCommand(t, ctx, `tell entry to create d,4`)
+			stopTestServer()
+
+			if err := restoreBackup(dir); err != nil {
+				t.Fatal(err)
+			}
+			ctx = crashTestServer(t)
+			for command, want := range map[string]string{
+				`tell entry to present a`:                    `1`,
+				`tell entry to present b`:                    `"two"`,
+				`tell entry to present c`:                    `3`,
+				`tell entry to present d`:                    `null`,
+				`tell entry to present where value is "two"`: `["b"]`,
+			} {
+				if got := runCommand(t, ctx, command); got != want {
+					t.Errorf("after restoring %s is %s, want %s", command, got, want)
+				}
+			}
+			if dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].values == nil {
+				t.Error("the restored table lost its value index")
+			}
+			// databases that weren't in the backup are left alone
+			users := testContext(t, "users", "app")
+			if dbs[users.DatabaseInUse].Tables[users.TableInUse].getEntry("root") == nil {
+				t.Fatal("the users database lost root")
+			}
+		})
+	}
+}
+
+// a backup without its manifest didn't finish, it can't be restored
+func TestUnfinishedBackupIsNotRestored(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	runCommand(t, ctx, `tell entry to create a,1`)
+	dir := filepath.Join(t.TempDir(), "backup")
+	runCommand(t, ctx, `tell database to backup to "`+dir+`"`)
+	waitForBackup(t, dir)
+	m, _ := readBackupManifest(filepath.Join(dir, backupManifestName))
+	if len(m.Databases) != 2 {
+		t.Fatalf("a backup of everything has %v in it", m.Databases)
+	}
+	os.Remove(filepath.Join(dir, backupManifestName))
+	stopTestServer()
+	if err := restoreBackup(dir); err == nil {
+		t.Fatal("an unfinished backup was restored")
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+log-structured (bitcask-style) storage engine
+every change to a table is appended to the active <n>.data file as a record (the same records as the wal),
+an in-memory keydir points at the newest record for every key
+once the active file gets too big it becomes immutable and a new one is started,
+immutable files get a <n>.hint file (every record's key and position) so startup doesn't have to read them
+a background compaction merges the immutable files into one, dropping overwritten and deleted records
+data file: "FUQLBC" | version (uint16) | records
+hint file: "FUQLHNT" | version (uint16) | section (see format.go) of op, table, key, offset, size, sequence, expires, ...
+expires (a byte) is 1 if the record is an add with a deadline, the add is then also the key's newest expire record
+*/
+
+const bitcaskMagic = "FUQLBC"
+
+const hintMagic = "FUQLHNT"
+
+const bitcaskVersion uint16 = 1
+
+const defaultBitcaskMaxFileSize = 64 << 20
+
+const defaultBitcaskCompactInterval = 10 * time.Minute
+
+type bitcaskPos struct {
+	file   uint32
+	offset int64
+	size   uint32
+}
+
+// bitcaskTable is the keydir of a single table
+type bitcaskTable struct {
+	created bitcaskPos
+	// index is the newest index values or forget index record
+	index   bitcaskPos
+	indexed bool
+	keys    map[interface{}]bitcaskPos
+	// expiries is the newest expire record of every key that has one
+	expiries map[interface{}]bitcaskPos
+}
+
+type hintEntry struct {
+	op    walOp
+	table string
+	key   interface{}
+	pos   bitcaskPos
+	// sequence is the record's sequence number (see wal.go)
+	sequence uint64
+	// expires is true if the record is an add that has the entry's deadline in it
+	expires bool
+}
+
+type bitcask struct {
+	mu          sync.Mutex
+	dir         string
+	maxFileSize int64
+	active      *os.File
+	activeID    uint32
+	activeSize  int64
+	activeHints []hintEntry
+	readers     map[uint32]*os.File
+	keydir      map[string]*bitcaskTable
+	// lastSequence is the sequence number of the newest record, anything older in the wal is already here
+	lastSequence uint64
+	// compactedID is the file the last compaction wrote, there's nothing to do if it's the only immutable file
+	compactedID uint32
+	// compacting is held for the whole of a compaction so close can wait for it
+	compacting sync.Mutex
+	stop       chan struct{}
+}
+
+func bitcaskMaxFileSize() int64 {
+	if size, ok := config["bitcask_max_file_size"].(int64); ok && size > 0 {
+		return size
+	}
+	return defaultBitcaskMaxFileSize
+}
+
+func bitcaskCompactInterval() time.Duration {
+	if seconds, ok := config["bitcask_compact_interval"].(int64); ok && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultBitcaskCompactInterval
+}
+
+func (bc *bitcask) dataPath(id uint32) string {
+	return filepath.Join(bc.dir, fmt.Sprintf("%d.data", id))
+}
+
+func (bc *bitcask) hintPath(id uint32) string {
+	return filepath.Join(bc.dir, fmt.Sprintf("%d.hint", id))
+}
+
+// bitcaskFileIDs returns the ids of every data file in dir, oldest first
+func bitcaskFileIDs(dir string) ([]uint32, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".data") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".data"), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func isBitcaskDir(dir string) bool {
+	ids, err := bitcaskFileIDs(dir)
+	return err == nil && len(ids) > 0
+}
+
+// openBitcask builds the keydir from the hint files (or the data files if there's no hint) and starts a new active file
+func openBitcask(dir string) (*bitcask, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	bc := &bitcask{
+		dir:         dir,
+		maxFileSize: bitcaskMaxFileSize(),
+		readers:     make(map[uint32]*os.File),
+		keydir:      make(map[string]*bitcaskTable),
+		stop:        make(chan struct{}),
+	}
+	ids, err := bitcaskFileIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		hints, err := bc.readHints(id)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Printf("WARNING: hint file %s is damaged, reading the data file instead: %v\n", bc.hintPath(id), err)
+			}
+			hints, err = bc.scanDataFile(id, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, h := range hints {
+			bc.applyHint(h)
+		}
+		bc.activeID = id
+	}
+	if err := bc.startActive(bc.activeID + 1); err != nil {
+		return nil, err
+	}
+	go bc.compactLoop(bitcaskCompactInterval())
+	return bc, nil
+}
+
+func (bc *bitcask) startActive(id uint32) error {
+	file, err := os.OpenFile(bc.dataPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	header := appendUint16([]byte(bitcaskMagic), bitcaskVersion)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	bc.active = file
+	bc.activeID = id
+	bc.activeSize = int64(len(header))
+	bc.activeHints = nil
+	return syncDir(bc.dir)
+}
+
+// applyHint updates the keydir with a record, records have to be applied oldest first
+func (bc *bitcask) applyHint(h hintEntry) {
+	if h.sequence > bc.lastSequence {
+		bc.lastSequence = h.sequence
+	}
+	switch h.op {
+	case walOpCreateTable:
+		bc.keydir[h.table] = &bitcaskTable{created: h.pos, keys: make(map[interface{}]bitcaskPos), expiries: make(map[interface{}]bitcaskPos)}
+		return
+	case walOpDeleteTable:
+		delete(bc.keydir, h.table)
+		return
+	}
+	table, ok := bc.keydir[h.table]
+	if !ok {
+		return
+	}
+	switch h.op {
+	case walOpAddEntry:
+		// the first add of a key wins, like in the table itself
+		if _, ok := table.keys[h.key]; !ok {
+			table.keys[h.key] = h.pos
+			if h.expires {
+				table.expiries[h.key] = h.pos
+			}
+		}
+	case walOpChangeEntry:
+		table.keys[h.key] = h.pos
+	case walOpDeleteEntry:
+		delete(table.keys, h.key)
+		delete(table.expiries, h.key)
+	case walOpExpireEntry:
+		if _, ok := table.keys[h.key]; ok {
+			table.expiries[h.key] = h.pos
+		}
+	case walOpIndexValues, walOpForgetIndex:
+		table.index = h.pos
+		table.indexed = h.op == walOpIndexValues
+	}
+}
+
+// isLive is true if the keydir still needs the record, deletes never are, compact keeps the ones older files still need
+func (bc *bitcask) isLive(h hintEntry) bool {
+	table, ok := bc.keydir[h.table]
+	if !ok {
+		return false
+	}
+	switch h.op {
+	case walOpCreateTable:
+		return table.created == h.pos
+	case walOpAddEntry, walOpChangeEntry:
+		if table.keys[h.key] == h.pos {
+			return true
+		}
+		pos, ok := table.expiries[h.key]
+		return h.expires && ok && pos == h.pos
+	case walOpExpireEntry:
+		pos, ok := table.expiries[h.key]
+		return ok && pos == h.pos
+	case walOpIndexValues, walOpForgetIndex:
+		return table.index == h.pos
+	}
+	return false
+}
+
+// append writes a mutation to the active file, database level mutations aren't stored here
+func (bc *bitcask) append(m mutation) error {
+	if m.Op == walOpCreateDatabase || m.Op == walOpDeleteDatabase {
+		return nil
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.activeSize >= bc.maxFileSize {
+		if err := bc.rotate(); err != nil {
+			return err
+		}
+	}
+	record := encodeMutation(m)
+	if _, err := bc.active.Write(record); err != nil {
+		return err
+	}
+	h := hintEntry{op: m.Op, table: m.Table, key: m.Key, pos: bitcaskPos{file: bc.activeID, offset: bc.activeSize, size: uint32(len(record))}, sequence: m.Sequence, expires: m.Expires != 0}
+	bc.activeSize += int64(len(record))
+	bc.activeHints = append(bc.activeHints, h)
+	bc.applyHint(h)
+	return nil
+}
+
+// rotate makes the active file immutable (with a hint file) and starts a new one
+func (bc *bitcask) rotate() error {
+	if err := bc.active.Sync(); err != nil {
+		return err
+	}
+	if err := bc.active.Close(); err != nil {
+		return err
+	}
+	if err := bc.writeHints(bc.activeID, bc.activeHints); err != nil {
+		return err
+	}
+	return bc.startActive(bc.activeID + 1)
+}
+
+func (bc *bitcask) sync() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.active.Sync()
+}
+
+func (bc *bitcask) close() error {
+	close(bc.stop)
+	bc.compacting.Lock()
+	defer bc.compacting.Unlock()
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	for id, reader := range bc.readers {
+		reader.Close()
+		delete(bc.readers, id)
+	}
+	if err := bc.active.Sync(); err != nil {
+		return err
+	}
+	if err := bc.active.Close(); err != nil {
+		return err
+	}
+	return bc.writeHints(bc.activeID, bc.activeHints)
+}
+
+func (bc *bitcask) writeHints(id uint32, hints []hintEntry) error {
+	out := appendUint16([]byte(hintMagic), bitcaskVersion)
+	var payload []byte
+	for _, h := range hints {
+		payload = append(payload, byte(h.op))
+		payload = appendString(payload, h.table)
+		payload = appendValue(payload, h.key)
+		payload = appendUint64(payload, uint64(h.pos.offset))
+		payload = appendUint32(payload, h.pos.size)
+		payload = appendUint64(payload, h.sequence)
+		if h.expires {
+			payload = append(payload, 1)
+		} else {
+			payload = append(payload, 0)
+		}
+	}
+	out = appendSection(out, payload)
+	return writeFileAtomic(bc.hintPath(id), 0, func(w *bufio.Writer) error {
+		_, err := w.Write(sealFile(out))
+		return err
+	})
+}
+
+func (bc *bitcask) readHints(id uint32) ([]hintEntry, error) {
+	data, err := readSealedFile(bc.hintPath(id))
+	if err != nil {
+		return nil, err
+	}
+	headerLength := len(hintMagic) + 2
+	if len(data) < headerLength || !bytes.HasPrefix(data, []byte(hintMagic)) {
+		return nil, errors.New("not a hint file")
+	}
+	version := binary.BigEndian.Uint16(data[len(hintMagic):])
+	if version != bitcaskVersion {
+		return nil, fmt.Errorf("unsupported hint file version %d", version)
+	}
+	payload, _, err := readSection(data[headerLength:])
+	if err != nil {
+		return nil, err
+	}
+	var hints []hintEntry
+	for len(payload) > 0 {
+		h := hintEntry{op: walOp(payload[0]), pos: bitcaskPos{file: id}}
+		var offset uint64
+		if h.table, payload, err = readString(payload[1:]); err != nil {
+			return nil, err
+		}
+		if h.key, payload, err = readValue(payload); err != nil {
+			return nil, err
+		}
+		if offset, payload, err = readUint64(payload); err != nil {
+			return nil, err
+		}
+		if h.pos.size, payload, err = readUint32(payload); err != nil {
+			return nil, err
+		}
+		if h.sequence, payload, err = readUint64(payload); err != nil {
+			return nil, err
+		}
+		h.pos.offset = int64(offset)
+		if len(payload) < 1 {
+			return nil, errors.New("hint is truncated")
+		}
+		h.expires, payload = payload[0] == 1, payload[1:]
+		hints = append(hints, h)
+	}
+	return hints, nil
+}
+
+// scanDataFile reads every intact record in a data file, calling each (if it's not nil) with the raw record
+// a torn record at the end of a file (from a crash) ends it
+func (bc *bitcask) scanDataFile(id uint32, each func(h hintEntry, record []byte) error) ([]hintEntry, error) {
+	data, err := os.ReadFile(bc.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	headerLength := len(bitcaskMagic) + 2
+	if len(data) < headerLength || !bytes.HasPrefix(data, []byte(bitcaskMagic)) {
+		fmt.Printf("WARNING: %s isn't a data file, skipping it\n", bc.dataPath(id))
+		return nil, nil
+	}
+	offset := int64(headerLength)
+	var hints []hintEntry
+	for offset < int64(len(data)) {
+		m, size, err := decodeRecord(data[offset:])
+		if err != nil {
+			fmt.Printf("WARNING: %s ends with a damaged record, ignoring the rest: %v\n", bc.dataPath(id), err)
+			break
+		}
+		h := hintEntry{op: m.Op, table: m.Table, key: m.Key, pos: bitcaskPos{file: id, offset: offset, size: size}, sequence: m.Sequence, expires: m.Expires != 0}
+		if each != nil {
+			if err := each(h, data[offset:offset+int64(size)]); err != nil {
+				return nil, err
+			}
+		}
+		hints = append(hints, h)
+		offset += int64(size)
+	}
+	return hints, nil
+}
+
+// decodeRecord decodes the record at the start of data and returns its size
+func decodeRecord(data []byte) (mutation, uint32, error) {
+	if len(data) < 8 || uint32(len(data)-8) < binary.BigEndian.Uint32(data) {
+		return mutation{}, 0, errors.New("record is truncated")
+	}
+	payload := data[8 : 8+binary.BigEndian.Uint32(data)]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:]) {
+		return mutation{}, 0, errors.New("record checksum mismatch")
+	}
+	m, err := decodeMutation(payload)
+	return m, uint32(8 + len(payload)), err
+}
+
+func (bc *bitcask) readRecord(pos bitcaskPos) (mutation, error) {
+	reader, ok := bc.readers[pos.file]
+	if !ok {
+		var err error
+		reader, err = os.Open(bc.dataPath(pos.file))
+		if err != nil {
+			return mutation{}, err
+		}
+		bc.readers[pos.file] = reader
+	}
+	record := make([]byte, pos.size)
+	if _, err := reader.ReadAt(record, pos.offset); err != nil && err != io.EOF {
+		return mutation{}, err
+	}
+	m, _, err := decodeRecord(record)
+	return m, err
+}
+
+// tables returns every table in the keydir (oldest first), they're read from the data files when they're first used
+func (bc *bitcask) tables() []Table {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	var names []string
+	for name := range bc.keydir {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return positionBefore(bc.keydir[names[i]].created, bc.keydir[names[j]].created)
+	})
+	var tables []Table
+	for _, name := range names {
+		tables = append(tables, Table{Name: name, lazy: bc.tableLoader(name)})
+	}
+	return tables
+}
+
+func positionBefore(a bitcaskPos, b bitcaskPos) bool {
+	if a.file != b.file {
+		return a.file < b.file
+	}
+	return a.offset < b.offset
+}
+
+func (bc *bitcask) tableLoader(name string) func() (Table, error) {
+	return func() (Table, error) {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		table := Table{Name: name}
+		kd, ok := bc.keydir[name]
+		if !ok {
+			return table, nil
+		}
+		created, err := bc.readRecord(kd.created)
+		if err != nil {
+			return table, fmt.Errorf("table %s: %v", name, err)
+		}
+		if declaration, ok := created.Value.(string); ok {
+			if table.schema, err = parseSchema(declaration); err != nil {
+				return table, fmt.Errorf("table %s: %v", name, err)
+			}
+		}
+		positions := make([]bitcaskPos, 0, len(kd.keys))
+		for _, pos := range kd.keys {
+			positions = append(positions, pos)
+		}
+		sort.Slice(positions, func(i, j int) bool { return positionBefore(positions[i], positions[j]) })
+		for _, pos := range positions {
+			m, err := bc.readRecord(pos)
+			if err != nil {
+				return table, fmt.Errorf("table %s: %v", name, err)
+			}
+			table.addEntry(m.Key, m.Value)
+			table.setMetadata(m)
+		}
+		for _, pos := range kd.expiries {
+			m, err := bc.readRecord(pos)
+			if err != nil {
+				return table, fmt.Errorf("table %s: %v", name, err)
+			}
+			if m.Op == walOpAddEntry {
+				table.expireEntry(m.Key, time.Unix(0, m.Expires).UTC())
+			} else {
+				table.expireEntry(m.Key, m.Value)
+			}
+		}
+		if kd.indexed {
+			table.indexValues()
+		}
+		return table, nil
+	}
+}
+
+type bitcaskMove struct {
+	h      hintEntry
+	newPos bitcaskPos
+}
+
+// compact merges every immutable data file into one, keeping only the records the keydir still points at
+// and the deletes of anything older files still have, those files are only removed after the merged file is renamed in
+// the files are read and written without holding the lock, only checking and swapping the keydir takes it
+func (bc *bitcask) compact() error {
+	bc.compacting.Lock()
+	defer bc.compacting.Unlock()
+	bc.mu.Lock()
+	ids, err := bitcaskFileIDs(bc.dir)
+	activeID := bc.activeID
+	compactedID := bc.compactedID
+	bc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var immutable []uint32
+	for _, id := range ids {
+		if id < activeID {
+			immutable = append(immutable, id)
+		}
+	}
+	if len(immutable) == 0 || (len(immutable) == 1 && immutable[0] == compactedID) {
+		return nil
+	}
+
+	// the merged file takes the newest immutable id so it still sorts before the active file
+	target := immutable[len(immutable)-1]
+	tmpPath := bc.dataPath(target) + ".merge"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	writer := bufio.NewWriter(file)
+	header := appendUint16([]byte(bitcaskMagic), bitcaskVersion)
+	if _, err := writer.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	offset := int64(len(header))
+	var moves []bitcaskMove
+	var hints []hintEntry
+	// the first file every table and key shows up in, a delete has to be kept while an older file that's about to be removed has records it deletes
+	tableSeen := make(map[string]uint32)
+	keySeen := make(map[string]map[interface{}]uint32)
+	for _, id := range immutable {
+		_, err := bc.scanDataFile(id, func(h hintEntry, record []byte) error {
+			if _, ok := tableSeen[h.table]; !ok {
+				tableSeen[h.table] = id
+				keySeen[h.table] = make(map[interface{}]uint32)
+			}
+			keyFile, keyOK := keySeen[h.table][h.key]
+			if !keyOK && h.key != nil {
+				keySeen[h.table][h.key] = id
+			}
+			bc.mu.Lock()
+			live := bc.isLive(h)
+			bc.mu.Unlock()
+			// until the older files are gone a crash would bring back what they have without the delete
+			switch {
+			case h.op == walOpDeleteTable && tableSeen[h.table] < id:
+			case h.op == walOpDeleteEntry && keyOK && keyFile < id:
+			case !live:
+				return nil
+			}
+			// written again so it's sealed with the current key (or sealed at all, if encryption was turned on since)
+			m, _, err := decodeRecord(record)
+			if err != nil {
+				return err
+			}
+			record = encodeMutation(m)
+			if _, err := writer.Write(record); err != nil {
+				return err
+			}
+			newPos := bitcaskPos{file: target, offset: offset, size: uint32(len(record))}
+			if live {
+				moves = append(moves, bitcaskMove{h: h, newPos: newPos})
+			}
+			moved := h
+			moved.pos = newPos
+			hints = append(hints, moved)
+			offset += int64(len(record))
+			return nil
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	for _, id := range immutable {
+		if reader, ok := bc.readers[id]; ok {
+			reader.Close()
+			delete(bc.readers, id)
+		}
+	}
+	// the old hint file doesn't match the merged file, without one the data file is read at startup
+	if err := os.Remove(bc.hintPath(target)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(tmpPath, bc.dataPath(target)); err != nil {
+		return err
+	}
+	// the merged file has to be there for good before anything it replaces is removed
+	if err := syncDir(bc.dir); err != nil {
+		return err
+	}
+	// point the keydir at the merged file, unless the key changed while we were merging
+	for _, move := range moves {
+		if !bc.isLive(move.h) {
+			continue
+		}
+		table := bc.keydir[move.h.table]
+		switch move.h.op {
+		case walOpCreateTable:
+			table.created = move.newPos
+		case walOpAddEntry, walOpChangeEntry:
+			// an add with a deadline can be the key's value, its expiry or both
+			if table.keys[move.h.key] == move.h.pos {
+				table.keys[move.h.key] = move.newPos
+			}
+			if pos, ok := table.expiries[move.h.key]; ok && pos == move.h.pos {
+				table.expiries[move.h.key] = move.newPos
+			}
+		case walOpExpireEntry:
+			table.expiries[move.h.key] = move.newPos
+		case walOpIndexValues, walOpForgetIndex:
+			table.index = move.newPos
+		}
+	}
+	bc.compactedID = target
+	// older files go first, if we crash halfway the ones left are still read in the right order
+	for _, id := range immutable[:len(immutable)-1] {
+		os.Remove(bc.dataPath(id))
+		os.Remove(bc.hintPath(id))
+	}
+	if err := bc.writeHints(target, hints); err != nil {
+		return err
+	}
+	return syncDir(bc.dir)
+}
+
+func (bc *bitcask) compactLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.stop:
+			return
+		case <-ticker.C:
+			if err := bc.compact(); err != nil {
+				fmt.Println("WARNING: error compacting ", bc.dir, ": ", err)
+			}
+		}
+	}
+}
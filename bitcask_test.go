@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bitcaskContents describes every table in a bitcask, one line per entry
+func bitcaskContents(t *testing.T, bc *bitcask) string {
+	t.Helper()
+	var lines []string
+	for _, table := range bc.tables() {
+		if err := table.load(); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("table %s indexed %v", table.Name, table.values != nil))
+		for _, entry := range table.entries() {
+			lines = append(lines, fmt.Sprintf("%s %s=%s version %d expires %d by %s", table.Name, formatLiteral(entry.Key), formatLiteral(entry.Value), entry.version, entry.expires, entry.writer))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func openTestBitcask(t *testing.T, dir string) *bitcask {
+	t.Helper()
+	bc, err := openBitcask(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+func TestBitcaskReloadAndCompaction(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	// small files, so there are immutable files with hints to compact
+	config = map[string]interface{}{"database_storage_path": filepath.Dir(dir), "bitcask_max_file_size": int64(200)}
+	bc := openTestBitcask(t, dir)
+	now := uint64(0)
+	apply := func(m mutation) {
+		now++
+		m.Sequence, m.Time, m.Database = now, int64(now), "app"
+		if m.Op == walOpAddEntry || m.Op == walOpChangeEntry {
+			m.Created, m.User = int64(now), "root"
+		}
+		if err := bc.append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(mutation{Op: walOpCreateTable, Table: "t"})
+	for i := int64(0); i < 10; i++ {
+		apply(mutation{Op: walOpAddEntry, Table: "t", Key: i, Value: fmt.Sprintf("value %d", i), Version: 1})
+	}
+	for version := uint64(2); version < 6; version++ {
+		apply(mutation{Op: walOpChangeEntry, Table: "t", Key: int64(0), Value: int64(version), Version: version})
+	}
+	apply(mutation{Op: walOpDeleteEntry, Table: "t", Key: int64(1)})
+	deadline := time.Now().Add(time.Hour).UTC()
+	apply(mutation{Op: walOpExpireEntry, Table: "t", Key: int64(2), Value: deadline})
+	apply(mutation{Op: walOpAddEntry, Table: "t", Key: "ttl", Value: "x", Version: 1, Expires: deadline.UnixNano()})
+	apply(mutation{Op: walOpCreateTable, Table: "gone"})
+	apply(mutation{Op: walOpAddEntry, Table: "gone", Key: "k", Value: "v", Version: 1})
+	apply(mutation{Op: walOpDeleteTable, Table: "gone"})
+	apply(mutation{Op: walOpIndexValues, Table: "t"})
+	want := bitcaskContents(t, bc)
+	if !strings.Contains(want, `t 0=5 version 5`) || !strings.Contains(want, fmt.Sprintf(`t "ttl"="x" version 1 expires %d`, deadline.UnixNano())) || strings.Contains(want, "t 1=") || strings.Contains(want, "gone") {
+		t.Fatalf("bitcask doesn't have the changes:\n%s", want)
+	}
+
+	reopen := func(what string) {
+		t.Helper()
+		if err := bc.close(); err != nil {
+			t.Fatal(err)
+		}
+		bc = openTestBitcask(t, dir)
+		if got := bitcaskContents(t, bc); got != want {
+			t.Fatalf("after %s the bitcask has\n%s\nwant\n%s", what, got, want)
+		}
+		if bc.lastSequence != now {
+			t.Fatalf("after %s the newest record is from %d, want %d", what, bc.lastSequence, now)
+		}
+	}
+	reopen("reopening")
+
+	before, _ := bitcaskFileIDs(dir)
+	if err := bc.compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := bitcaskFileIDs(dir)
+	if len(after) >= len(before) {
+		t.Fatalf("compaction left %d data files of %d", len(after), len(before))
+	}
+	if got := bitcaskContents(t, bc); got != want {
+		t.Fatalf("after compacting the bitcask has\n%s\nwant\n%s", got, want)
+	}
+	reopen("compacting")
+
+	// without hint files every data file is read instead
+	hints, _ := filepath.Glob(filepath.Join(dir, "*.hint"))
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+	reopen("losing the hints")
+
+	// a crash can leave a torn record at the end of the active file
+	ids, _ := bitcaskFileIDs(dir)
+	active := bc.dataPath(ids[len(ids)-1])
+	bc.close()
+	torn := encodeMutation(mutation{Op: walOpAddEntry, Sequence: now + 1, Database: "app", Table: "t", Key: "torn", Value: "x"})
+	file, err := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(torn[:len(torn)-2])
+	file.Close()
+	bc = openTestBitcask(t, dir)
+	reopen("a torn record")
+	bc.close()
+}
+
+// a crash after the merged file is renamed in but before the files it replaces are removed doesn't bring deleted keys or tables back
+func TestBitcaskCompactionCrash(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	config = map[string]interface{}{"database_storage_path": filepath.Dir(dir), "bitcask_max_file_size": int64(1 << 20)}
+	bc := openTestBitcask(t, dir)
+	sequence := uint64(0)
+	apply := func(m mutation) {
+		sequence++
+		m.Sequence, m.Time, m.Database = sequence, int64(sequence), "app"
+		if err := bc.append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate := func() {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		if err := bc.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(mutation{Op: walOpCreateTable, Table: "t"})
+	apply(mutation{Op: walOpAddEntry, Table: "t", Key: "deleted", Value: int64(1), Version: 1})
+	apply(mutation{Op: walOpAddEntry, Table: "t", Key: "readded", Value: int64(1), Version: 1})
+	apply(mutation{Op: walOpAddEntry, Table: "t", Key: "kept", Value: int64(1), Version: 1})
+	apply(mutation{Op: walOpCreateTable, Table: "gone"})
+	apply(mutation{Op: walOpAddEntry, Table: "gone", Key: "k", Value: int64(1), Version: 1})
+	rotate()
+	apply(mutation{Op: walOpDeleteEntry, Table: "t", Key: "deleted"})
+	apply(mutation{Op: walOpDeleteEntry, Table: "t", Key: "readded"})
+	apply(mutation{Op: walOpAddEntry, Table: "t", Key: "readded", Value: int64(2), Version: 1})
+	apply(mutation{Op: walOpDeleteTable, Table: "gone"})
+	rotate()
+	want := bitcaskContents(t, bc)
+
+	// keep a copy of the oldest file, putting it back after compacting is what a crash before it's removed leaves behind
+	oldest := map[string][]byte{}
+	for _, path := range []string{bc.dataPath(1), bc.hintPath(1)} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldest[path] = data
+	}
+	if err := bc.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bc.dataPath(1)); !os.IsNotExist(err) {
+		t.Fatal("compaction didn't remove the oldest file")
+	}
+	bc.close()
+	for path, data := range oldest {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc = openTestBitcask(t, dir)
+	if got := bitcaskContents(t, bc); got != want {
+		t.Fatalf("after a crash while compacting the bitcask has\n%s\nwant\n%s", got, want)
+	}
+
+	// once the older file is gone the next compaction drops the deletes
+	os.Remove(bc.dataPath(1))
+	os.Remove(bc.hintPath(1))
+	apply(mutation{Op: walOpAddEntry, Table: "t", Key: "later", Value: int64(3), Version: 1})
+	rotate()
+	if err := bc.compact(); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := bitcaskFileIDs(dir)
+	hints, err := bc.scanDataFile(ids[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range hints {
+		if h.op == walOpDeleteEntry || h.op == walOpDeleteTable {
+			t.Errorf("the second compaction kept a delete of %s %v", h.table, h.key)
+		}
+	}
+	bc.close()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+offline integrity checker
+fuqldb --check <path> looks through a database file, a database directory or the whole storage directory without starting the server
+and lists everything wrong with it (unparseable lines, duplicate keys, checksum mismatches, ...)
+fuqldb --repair <path> does the same, then writes whatever could be saved next to the directory path is in,
+storage/app is repaired to storage.repaired/app with the list in storage.repaired/app.report,
+so the repaired copies are never loaded as databases of their own and storage.repaired can be used as a storage path
+the original is never touched
+*/
+
+type checkReport struct {
+	problems []string
+}
+
+func (r *checkReport) add(where string, format string, args ...interface{}) {
+	r.problems = append(r.problems, where+": "+fmt.Sprintf(format, args...))
+}
+
+// runCheck checks (and maybe repairs) path, it returns how many problems were found
+func runCheck(path string, repair bool) (int, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	return checkPath(path, repairedPath(path), repair)
+}
+
+// repairedPath is where the repaired copy of path goes, in a directory next to the one path is in
+func repairedPath(path string) string {
+	return filepath.Join(filepath.Dir(path)+".repaired", filepath.Base(path))
+}
+
+func checkPath(path string, out string, repair bool) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() && !isBitcaskDir(path) && !isDatabaseDir(path) {
+		// a storage directory, check every database in it, storage is repaired to storage.repaired
+		names, err := databaseNames(path)
+		if err != nil {
+			return 0, err
+		}
+		total := 0
+		for _, name := range names {
+			dbName := name
+			if _, statErr := os.Stat(filepath.Join(path, dbName)); statErr != nil {
+				dbName += ".db"
+			}
+			count, err := checkPath(filepath.Join(path, dbName), filepath.Join(path+".repaired", dbName), repair)
+			if err != nil {
+				return total, err
+			}
+			total += count
+		}
+		return total, nil
+	}
+	report := &checkReport{}
+	if repair {
+		if err := os.MkdirAll(filepath.Dir(out), 0700); err != nil {
+			return 0, err
+		}
+	}
+	switch {
+	case !info.IsDir():
+		db := salvageFile(path, report)
+		if repair {
+			err = writeFileAtomic(out, 0, func(w *bufio.Writer) error {
+				compressed, err := compressSnapshot(serializeDB(db))
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(sealFile(compressed))
+				return err
+			})
+		}
+	case isBitcaskDir(path):
+		err = salvageBitcaskDir(path, out, repair, report)
+	default:
+		db := salvageDatabaseDir(path, report)
+		if repair {
+			err = db.saveDB(out)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, problem := range report.problems {
+		fmt.Println(problem)
+	}
+	if len(report.problems) == 0 {
+		fmt.Println(path + ": no problems found")
+	}
+	if repair {
+		text := strings.Join(report.problems, "\n") + "\n"
+		if err := os.WriteFile(out+".report", []byte(text), 0600); err != nil {
+			return 0, err
+		}
+		fmt.Println("repaired copy written to", out)
+	}
+	return len(report.problems), nil
+}
+
+// salvageFile reads a database file in either format, keeping everything that's intact
+func salvageFile(path string, report *checkReport) Database {
+	data, err := readSealedFile(path)
+	if err == nil {
+		data, err = decompressSnapshot(data)
+	}
+	if err != nil {
+		report.add(path, "%v", err)
+		return Database{}
+	}
+	var db Database
+	if isBinaryFormat(data) {
+		db = salvageBinary(path, data, report)
+	} else {
+		db = salvageLegacy(path, data, report)
+	}
+	removeDuplicates(path, &db, report)
+	return db
+}
+
+func salvageBinary(path string, data []byte, report *checkReport) Database {
+	var db Database
+	headerLength := len(formatMagic) + 2 + 4
+	if len(data) < headerLength+4 {
+		report.add(path, "header is truncated, nothing could be saved")
+		return db
+	}
+	header := data[:headerLength]
+	version := binary.BigEndian.Uint16(header[len(formatMagic):])
+	count := binary.BigEndian.Uint32(header[len(formatMagic)+2:])
+	if crc32.ChecksumIEEE(header) != binary.BigEndian.Uint32(data[headerLength:]) {
+		report.add(path, "header checksum mismatch, reading tables until the end of the file")
+		count = ^uint32(0)
+	} else if version != formatVersion {
+		report.add(path, "unsupported format version %d, nothing could be saved", version)
+		return db
+	}
+	rest := data[headerLength+4:]
+	i := uint32(0)
+	for ; i < count && len(rest) > 0; i++ {
+		length, next, err := readUint32(rest)
+		if err != nil || uint32(len(next)) < length+4 {
+			report.add(path, "table %d: section is truncated, dropped it and the rest of the file", i)
+			return db
+		}
+		payload := next[:length]
+		rest = next[length+4:]
+		name, _, _ := readString(payload)
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(next[length:]) {
+			report.add(path, "table %d (%q): checksum mismatch, dropped it", i, name)
+			continue
+		}
+		table, err := decodeTable(payload)
+		if err != nil {
+			report.add(path, "table %d (%q): %v, dropped it", i, name, err)
+			continue
+		}
+		db.Tables = append(db.Tables, table)
+	}
+	if count != ^uint32(0) && i < count {
+		report.add(path, "header says %d tables but the file ends after %d", count, i)
+	}
+	if len(rest) != 0 {
+		report.add(path, "%d trailing bytes after the last table, dropped them", len(rest))
+	}
+	return db
+}
+
+// salvageLegacy is decodeLegacyDB that skips bad lines instead of giving up
+func salvageLegacy(path string, data []byte, report *checkReport) Database {
+	db, err := scanLegacyDB(data, func(lineNumber int, problem string) error {
+		report.add(fmt.Sprintf("%s:%d", path, lineNumber), "%s, dropped the line", problem)
+		return nil
+	})
+	if err != nil {
+		report.add(path, "%v, dropped the rest of the file", err)
+	}
+	return db
+}
+
+// removeDuplicates keeps the first entry for every key, like lookups always have
+func removeDuplicates(path string, db *Database, report *checkReport) {
+	for i := range db.Tables {
+		table := &db.Tables[i]
+		if table.duplicates == 0 {
+			continue
+		}
+		clean := Table{Name: table.Name, schema: table.schema}
+		seen := make(map[interface{}]bool)
+		for _, entry := range table.entries() {
+			if seen[entry.Key] {
+				report.add(path, "table %q: duplicate key %s, dropped all but the first", table.Name, formatValue(entry.Key))
+				continue
+			}
+			seen[entry.Key] = true
+			clean.addEntry(entry.Key, entry.Value)
+			// keep the entry as it was, expiry, version and metadata included
+			clean.Data[len(clean.Data)-1] = entry
+		}
+		if table.values != nil {
+			clean.indexValues()
+		} else {
+			// counts the entries that expire
+			clean.reindex()
+		}
+		*table = clean
+	}
+}
+
+// salvageDatabaseDir checks every manifest generation and the segments the newest intact one points at
+func salvageDatabaseDir(dir string, report *checkReport) Database {
+	var db Database
+	var newest *manifest
+	for generation := 0; generation <= snapshotGenerations(); generation++ {
+		path := generationPath(filepath.Join(dir, manifestName), generation)
+		m, err := readManifest(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			report.add(path, "%v", err)
+			continue
+		}
+		if newest == nil {
+			newest = &m
+		}
+	}
+	if newest == nil {
+		report.add(dir, "no intact manifest, nothing could be saved")
+		return db
+	}
+	for _, mt := range newest.Tables {
+		path := filepath.Join(dir, mt.File)
+		segment := salvageFile(path, report)
+		found := false
+		for _, table := range segment.Tables {
+			if table.Name == mt.Name && !found {
+				db.Tables = append(db.Tables, table)
+				found = true
+			} else {
+				report.add(path, "holds table %q instead of %q, dropped it", table.Name, mt.Name)
+			}
+		}
+		if !found {
+			report.add(path, "table %q could not be saved", mt.Name)
+		}
+	}
+	return db
+}
+
+// salvageBitcaskDir checks every record in every data file, the repaired copy has the intact ones and no hint files
+func salvageBitcaskDir(dir string, out string, repair bool, report *checkReport) error {
+	ids, err := bitcaskFileIDs(dir)
+	if err != nil {
+		return err
+	}
+	if repair {
+		if err := os.MkdirAll(out, 0700); err != nil {
+			return err
+		}
+	}
+	bc := &bitcask{dir: dir}
+	headerLength := len(bitcaskMagic) + 2
+	for _, id := range ids {
+		path := bc.dataPath(id)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(data) < headerLength || !bytes.HasPrefix(data, []byte(bitcaskMagic)) {
+			report.add(path, "not a data file, dropped it")
+			continue
+		}
+		kept := appendUint16([]byte(bitcaskMagic), bitcaskVersion)
+		for offset := headerLength; offset < len(data); {
+			rest := data[offset:]
+			if len(rest) < 8 || uint32(len(rest)-8) < binary.BigEndian.Uint32(rest) {
+				report.add(path, "record at %d is truncated, dropped the rest of the file", offset)
+				break
+			}
+			size := 8 + int(binary.BigEndian.Uint32(rest))
+			if _, _, err := decodeRecord(rest); err != nil {
+				report.add(path, "record at %d: %v, dropped it", offset, err)
+			} else {
+				kept = append(kept, rest[:size]...)
+			}
+			offset += size
+		}
+		if _, err := bc.readHints(id); err != nil && !errors.Is(err, os.ErrNotExist) {
+			report.add(bc.hintPath(id), "%v, it'll be rebuilt from the data file", err)
+		}
+		if repair {
+			err := writeFileAtomic(filepath.Join(out, filepath.Base(path)), 0, func(w *bufio.Writer) error {
+				_, err := w.Write(kept)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
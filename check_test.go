@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "storage")
+	config = map[string]interface{}{"database_storage_path": storage}
+	var good Database
+	good.addTable("t")
+	good.Tables[0].addEntry("k", int64(1))
+	if err := good.saveDB(filepath.Join(storage, "good")); err != nil {
+		t.Fatal(err)
+	}
+	// the old text format, keys are typed like decodeLegacyDB types them and a \ that doesn't escape a : is just a \
+	legacy := "t:\n42:a\nnot an entry\n42:b\npath:C\\dir\\x\\:y\n\n"
+	if err := os.WriteFile(filepath.Join(storage, "old.db"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := runCheck(storage, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems != 1 {
+		t.Fatalf("found %d problems, want the line that isn't an entry", problems)
+	}
+	if _, err := os.Stat(storage + ".repaired"); !os.IsNotExist(err) {
+		t.Fatal("checking without repairing wrote something")
+	}
+
+	if _, err := runCheck(storage, true); err != nil {
+		t.Fatal(err)
+	}
+	names, err := databaseNames(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("the storage directory has databases %v after repairing, want only good and old", names)
+	}
+	for _, name := range []string{"good.report", "old.db.report"} {
+		if _, err := os.Stat(filepath.Join(storage+".repaired", name)); err != nil {
+			t.Errorf("no report: %v", err)
+		}
+	}
+	repaired, err := loadDB(filepath.Join(storage+".repaired", "good"))
+	if err != nil || repaired.Tables[0].getEntry("k") == nil {
+		t.Fatalf("the repaired good database lost its entry (%v)", err)
+	}
+	repaired, err = loadDB(filepath.Join(storage+".repaired", "old.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &repaired.Tables[0]
+	for key, want := range map[interface{}]string{int64(42): "a", "42": "b", "path": `C\dir\x:y`} {
+		if entry := table.getEntry(key); entry == nil || entry.Value != want {
+			t.Errorf("repaired %s is %+v, want %q", formatLiteral(key), entry, want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+lists and sets
+an entry's value can be a List (ordered, elements can repeat) or a Set (unordered, every member once)
+tell list to push front|back <key> <value>, tell list to pop front|back <key>
+tell list to present <key> at <index>, tell list to present <key> from <start> to <stop>, tell list to present length <key>
+indexes start at 0, negative ones count from the end (-1 is the last element), ranges include both ends
+tell set to add <key> <member>, tell set to remove <key> <member>
+tell set to present <key>, tell set to present <key> has <member>, tell set to present size <key>,
+tell set to present <key> union <other key>, tell set to present <key> intersection <other key>
+pushing to or adding to a key that doesn't exist creates it
+the wal and the storage engine get the whole new value like they do for any other change
+elements are plain values (no records, lists or sets), set members can't be bytes either
+*/
+
+type List []interface{}
+
+type Set map[interface{}]bool
+
+// members returns the members of a set in order
+func (set Set) members() []interface{} {
+	return sortedKeys(set)
+}
+
+// checkElement makes sure v can go into a list (or a set, if member is true)
+func checkElement(v interface{}, member bool) error {
+	kind, err := kindOf(v)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case ValueUser, ValueRecord, ValueList, ValueSet, ValueDocument:
+		return errors.New("lists and sets can only hold plain values")
+	case ValueBytes:
+		if member {
+			return errors.New("bytes can't be set members")
+		}
+	}
+	return nil
+}
+
+// applyElementOp returns what value becomes after a list or set operation (or a document path change, element is then Record{path, value}),
+// value is nil if the key doesn't exist yet
+// the old value is never changed, whatever is holding on to it (a response, a snapshot) keeps seeing it as it was
+func applyElementOp(op walOp, value interface{}, element interface{}) (interface{}, error) {
+	switch op {
+	case walOpListPushFront, walOpListPushBack, walOpListPopFront, walOpListPopBack:
+		list, ok := value.(List)
+		if !ok && value != nil {
+			return nil, errors.New("value is not a list")
+		}
+		switch op {
+		case walOpListPushFront:
+			return append(List{element}, list...), nil
+		case walOpListPushBack:
+			return append(append(List{}, list...), element), nil
+		case walOpListPopFront:
+			if len(list) == 0 {
+				return list, nil
+			}
+			return append(List{}, list[1:]...), nil
+		default:
+			if len(list) == 0 {
+				return list, nil
+			}
+			return append(List{}, list[:len(list)-1]...), nil
+		}
+	case walOpSetAdd, walOpSetRemove:
+		set, ok := value.(Set)
+		if !ok && value != nil {
+			return nil, errors.New("value is not a set")
+		}
+		changed := make(Set, len(set)+1)
+		for member := range set {
+			changed[member] = true
+		}
+		if op == walOpSetAdd {
+			changed[element] = true
+		} else {
+			delete(changed, element)
+		}
+		return changed, nil
+	case walOpSetPath:
+		doc, ok := value.(Document)
+		if !ok {
+			return nil, errors.New("value is not a document")
+		}
+		change, ok := element.(Record)
+		if !ok || len(change) != 2 {
+			return nil, errors.New("bad path change")
+		}
+		path, _ := change[0].(string)
+		steps, err := parsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		return doc.setPath(steps, change[1])
+	}
+	return nil, fmt.Errorf("unknown element operation %d", op)
+}
+
+func isElementOp(op walOp) bool {
+	switch op {
+	case walOpListPushFront, walOpListPushBack, walOpListPopFront, walOpListPopBack, walOpSetAdd, walOpSetRemove, walOpSetPath:
+		return true
+	}
+	return false
+}
+
+// listIndex turns a possibly negative index into a position in a list of length n, false if it's outside the list
+func listIndex(index int64, n int) (int, bool) {
+	if index < 0 {
+		index += int64(n)
+	}
+	if index < 0 || index >= int64(n) {
+		return 0, false
+	}
+	return int(index), true
+}
+
+// listRange returns the elements from start to stop (both included), clamped to the list
+func listRange(list List, start int64, stop int64) List {
+	n := int64(len(list))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return List{}
+	}
+	return append(List{}, list[start:stop+1]...)
+}
+
+// combineSets returns the union or the intersection of two sets, in order
+func combineSets(a Set, b Set, union bool) []interface{} {
+	combined := make(Set)
+	for member := range a {
+		if union || b[member] {
+			combined[member] = true
+		}
+	}
+	if union {
+		for member := range b {
+			combined[member] = true
+		}
+	}
+	return combined.members()
+}
+
+// getCollection returns the value of an entry that should be a list or a set, nil if there's no entry
+func (ctx *Context) getCollection(key interface{}) (interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	entry := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key)
+	if entry == nil {
+		return nil, nil
+	}
+	return entry.Value, nil
+}
+
+// getList is getCollection for lists, a missing key is an empty list
+func (ctx *Context) getList(key interface{}) (List, error) {
+	value, err := ctx.getCollection(key)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := value.(List)
+	if !ok && value != nil {
+		return nil, fmt.Errorf("%s is not a list", formatValue(key))
+	}
+	return list, nil
+}
+
+// getSet is getCollection for sets, a missing key is an empty set
+func (ctx *Context) getSet(key interface{}) (Set, error) {
+	value, err := ctx.getCollection(key)
+	if err != nil {
+		return nil, err
+	}
+	set, ok := value.(Set)
+	if !ok && value != nil {
+		return nil, fmt.Errorf("%s is not a set", formatValue(key))
+	}
+	return set, nil
+}
+
+// changeCollection pushes, pops, adds or removes one element, pops return the element they took (nil if the list was empty)
+func (ctx *Context) changeCollection(op walOp, key interface{}, element interface{}) (interface{}, error) {
+	// make sure user has write permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermWrite {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	if table.schema != nil {
+		return nil, errors.New("table has a schema, its values are rows")
+	}
+	var err error
+	if key, err = normalizeValue(key); err != nil {
+		return nil, err
+	}
+	if element, err = normalizeValue(element); err != nil {
+		return nil, err
+	}
+	if err := checkElement(element, op == walOpSetAdd || op == walOpSetRemove); err != nil {
+		return nil, err
+	}
+	var current interface{}
+	if entry := table.getEntry(key); entry != nil {
+		current = entry.Value
+	} else if table.hasExpired(key) {
+		// the element op would land on the expired entry, get it out of the way first
+		err := commitMutation(mutation{Op: walOpDeleteEntry, Database: dbs[ctx.DatabaseInUse].Name, Table: table.Name, Key: key})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := applyElementOp(op, current, element); err != nil {
+		return nil, fmt.Errorf("%s: %v", formatValue(key), err)
+	}
+	// popping from an empty or missing list doesn't change anything
+	var popped interface{}
+	if op == walOpListPopFront || op == walOpListPopBack {
+		list, _ := current.(List)
+		if len(list) == 0 {
+			return nil, nil
+		}
+		if op == walOpListPopFront {
+			popped = list[0]
+		} else {
+			popped = list[len(list)-1]
+		}
+		element = nil
+	}
+	err = commitMutation(mutation{
+		Op:       op,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    table.Name,
+		Key:      key,
+		Value:    element,
+		User:     ctx.UserInUse,
+	})
+	return popped, err
+}
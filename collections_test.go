@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+// list, set and path changes are logged as whole values, so replaying records that were already applied changes nothing
+func TestReplayElementOpsTwice(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	for _, command := range []string{
+		`tell list to push back l 1`,
+		`tell list to push back l 2`,
+		`tell list to push front l 0`,
+		`tell list to pop back l`,
+		`tell set to add s "a"`,
+		`tell set to add s "b"`,
+		`tell set to remove s "a"`,
+		`tell entry to create d,json"{\"a\": 1}"`,
+		`tell entry to become d at .b,2`,
+	} {
+		runCommand(t, ctx, command)
+	}
+	mutations, err := readWAL(walPathFromConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mutations {
+		if isElementOp(m.Op) {
+			t.Fatalf("wal has element operation %d, want only adds and changes", m.Op)
+		}
+		if m.Database == "app" && (m.Op == walOpAddEntry || m.Op == walOpChangeEntry) {
+			// adds of keys that exist are refused, which leaves them as they are too
+			if err := applyMutation(m); err != nil && m.Op != walOpAddEntry {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := map[string]string{
+		`tell entry to present l`:         `[0,1]`,
+		`tell entry to present version l`: `4`,
+		`tell entry to present s`:         `{"b"}`,
+		`tell entry to present version s`: `3`,
+		`tell entry to present d`:         `json"{\"a\":1,\"b\":2}"`,
+	}
+	for command, value := range want {
+		if got := runCommand(t, ctx, command); got != value {
+			t.Errorf("%s is %s after replaying, want %s", command, got, value)
+		}
+	}
+}
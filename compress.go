@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+/*
+snapshot compression
+if snapshot_compression = "gzip" is set, segment files and backups are gzipped before they're written (and encrypted, see crypt.go)
+snapshot_compression_level picks the level, 1 (fastest) to 9 (smallest), default is gzip's default
+loadDB spots the gzip header on its own, so files written with and without compression can be mixed
+*/
+
+// gzipMagic is the first two bytes of every gzip stream
+const gzipMagic = "\x1f\x8b"
+
+func compressionEnabled() bool {
+	compression, _ := config["snapshot_compression"].(string)
+	return compression == "gzip"
+}
+
+func compressionLevel() int {
+	if level, ok := config["snapshot_compression_level"].(int64); ok {
+		return int(level)
+	}
+	return gzip.DefaultCompression
+}
+
+// validateCompressionConfig makes sure the compression keys in the config make sense
+func validateCompressionConfig() error {
+	if compression, ok := config["snapshot_compression"]; ok && compression != "gzip" && compression != "none" {
+		return fmt.Errorf("snapshot_compression: unknown compression %v, use gzip or none", compression)
+	}
+	if level := compressionLevel(); level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return fmt.Errorf("snapshot_compression_level: %d isn't between %d and %d", level, gzip.BestSpeed, gzip.BestCompression)
+	}
+	return nil
+}
+
+// compressSnapshot gzips data if compression is on
+func compressSnapshot(data []byte) ([]byte, error) {
+	if !compressionEnabled() {
+		return data, nil
+	}
+	var out bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&out, compressionLevel())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decompressSnapshot undoes compressSnapshot, anything that isn't gzipped is returned as it is
+func decompressSnapshot(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(gzipMagic)) {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
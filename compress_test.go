@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressedSnapshots(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	runCommand(t, ctx, `tell entry to create plain,"`+strings.Repeat("a", 1000)+`"`)
+	saveDatabases(true)
+
+	// turning compression on only changes what's written from now on, the files already there are still read
+	config["snapshot_compression"] = "gzip"
+	config["snapshot_compression_level"] = int64(9)
+	if err := validateCompressionConfig(); err != nil {
+		t.Fatal(err)
+	}
+	runCommand(t, ctx, `tell table to create u`)
+	other := testContext(t, "app", "u")
+	runCommand(t, other, `tell entry to create packed,"`+strings.Repeat("b", 1000)+`"`)
+	saveDatabases(true)
+	db := findDatabase("app")
+	if db.lastSaveBytes == 0 || db.lastSaveBytes >= db.lastSaveUncompressedBytes {
+		t.Fatalf("the save wrote %d bytes of %d", db.lastSaveBytes, db.lastSaveUncompressedBytes)
+	}
+	dir, _ := databaseDir("app")
+	for _, table := range db.Tables {
+		data, err := os.ReadFile(filepath.Join(dir, table.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gzipped := bytes.HasPrefix(data, []byte(gzipMagic)); gzipped != (table.Name == "u") {
+			t.Errorf("table %s is gzipped: %v", table.Name, gzipped)
+		}
+	}
+
+	ctx = crashTestServer(t)
+	if got := runCommand(t, ctx, `tell entry to present plain`); got != `"`+strings.Repeat("a", 1000)+`"` {
+		t.Fatalf("the uncompressed entry is %s", got)
+	}
+	other = testContext(t, "app", "u")
+	if got := runCommand(t, other, `tell entry to present packed`); got != `"`+strings.Repeat("b", 1000)+`"` {
+		t.Fatalf("the compressed entry is %s", got)
+	}
+
+	for key, value := range map[string]interface{}{"snapshot_compression": "zstd", "snapshot_compression_level": int64(10)} {
+		config[key] = value
+		if err := validateCompressionConfig(); err == nil {
+			t.Errorf("%s = %v isn't an error", key, value)
+		}
+		delete(config, key)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+encryption at rest
+if encryption_keyfile is set, everything the storage layer writes is encrypted with AES-256-GCM
+the keyfile has one hex encoded 32 byte key per line, the first one encrypts, the rest are only used to read older files
+whole files (segments, manifests, hints, backups): "FUQLENC" | version (uint16) | key id (8 bytes) | nonce | ciphertext
+log records (wal, bitcask data files) keep their length and checksum, only the payload is sealed: 0xff | key id | nonce | ciphertext
+a key id is the first 8 bytes of the sha256 of the key
+files written before encryption was turned on are still read as they are
+to rotate (or to encrypt what was written before encryption was turned on), put the new key on the first line of the keyfile
+(keeping the old one below it) and run tell database to rotate key, it runs in the background and prints when it's finished,
+once it has the old key can be removed
+*/
+
+const sealedMagic = "FUQLENC"
+
+const sealedVersion uint16 = 1
+
+// a record payload starting with this is sealed, no wal op has this value
+const sealedRecordMarker byte = 0xff
+
+const keyIDLength = 8
+
+type encryptionKey struct {
+	id   [keyIDLength]byte
+	aead cipher.AEAD
+}
+
+// keyring holds a []encryptionKey, empty if encryption is off, the first key is the one new data is sealed with
+// bitcask compaction seals records in its own goroutine, so it's swapped as a whole on rotation
+var keyring atomic.Value
+
+func encryptionKeys() []encryptionKey {
+	keys, _ := keyring.Load().([]encryptionKey)
+	return keys
+}
+
+func loadEncryptionKeys() error {
+	path, ok := config["encryption_keyfile"].(string)
+	if !ok {
+		keyring.Store([]encryptionKey(nil))
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys []encryptionKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("%s line %d: a key is 64 hex digits", path, i+1)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		key := encryptionKey{aead: aead}
+		sum := sha256.Sum256(raw)
+		copy(key.id[:], sum[:])
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s has no keys", path)
+	}
+	keyring.Store(keys)
+	return nil
+}
+
+func findKey(id []byte) (encryptionKey, error) {
+	keys := encryptionKeys()
+	for _, key := range keys {
+		if bytes.Equal(key.id[:], id) {
+			return key, nil
+		}
+	}
+	if len(keys) == 0 {
+		return encryptionKey{}, errors.New("data is encrypted but encryption_keyfile isn't set")
+	}
+	return encryptionKey{}, fmt.Errorf("data is encrypted with key %x, which isn't in the keyfile", id)
+}
+
+// seal encrypts plain with the current key, returning key id | nonce | ciphertext
+func seal(plain []byte, additional []byte) []byte {
+	key := encryptionKeys()[0]
+	out := append([]byte(nil), key.id[:]...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+	out = append(out, nonce...)
+	return key.aead.Seal(out, nonce, plain, additional)
+}
+
+func unseal(sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < keyIDLength {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	key, err := findKey(sealed[:keyIDLength])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[keyIDLength:]
+	if len(sealed) < key.aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	plain, err := key.aead.Open(nil, sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():], additional)
+	if err != nil {
+		return nil, errors.New("could not decrypt, wrong key or damaged data")
+	}
+	return plain, nil
+}
+
+func sealedFileHeader() []byte {
+	return appendUint16([]byte(sealedMagic), sealedVersion)
+}
+
+// sealFile encrypts a whole file, or returns it as it is if encryption is off
+func sealFile(data []byte) []byte {
+	if len(encryptionKeys()) == 0 {
+		return data
+	}
+	header := sealedFileHeader()
+	return append(header, seal(data, header)...)
+}
+
+func isSealedFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedMagic))
+}
+
+// unsealFile decrypts a file written by sealFile, anything else is returned as it is
+func unsealFile(data []byte) ([]byte, error) {
+	if !isSealedFile(data) {
+		return data, nil
+	}
+	headerLength := len(sealedMagic) + 2
+	if len(data) < headerLength {
+		return nil, errors.New("encrypted file header is truncated")
+	}
+	if version := binary.BigEndian.Uint16(data[len(sealedMagic):]); version == 0 || version > sealedVersion {
+		return nil, fmt.Errorf("unsupported encrypted file version %d", version)
+	}
+	return unseal(data[headerLength:], data[:headerLength])
+}
+
+// readSealedFile is os.ReadFile for files that may be encrypted
+func readSealedFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = unsealFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return data, nil
+}
+
+// sealRecord encrypts a log record's payload if encryption is on
+func sealRecord(payload []byte) []byte {
+	if len(encryptionKeys()) == 0 {
+		return payload
+	}
+	return append([]byte{sealedRecordMarker}, seal(payload, nil)...)
+}
+
+func unsealRecord(payload []byte) ([]byte, error) {
+	if len(payload) == 0 || payload[0] != sealedRecordMarker {
+		return payload, nil
+	}
+	return unseal(payload[1:], nil)
+}
+
+// sealedWithCurrentKey is true if sealed (without its marker or header) was sealed with the key new data uses
+func sealedWithCurrentKey(sealed []byte) bool {
+	return len(sealed) >= keyIDLength && bytes.Equal(sealed[:keyIDLength], encryptionKeys()[0].id[:])
+}
+
+// rotating is held while a key rotation runs, there's only ever one at a time
+var rotating sync.Mutex
+
+// rotateEncryptionKey rereads the keyfile and starts re-encrypting everything on disk with its first key
+// the wal is rewritten right away, only the main loop may touch it, and everything written from then on uses the new key
+// the rest is rewritten in the background so clients can keep going
+func rotateEncryptionKey() error {
+	if !rotating.TryLock() {
+		return errors.New("a key rotation is already running")
+	}
+	started := false
+	defer func() {
+		if !started {
+			rotating.Unlock()
+		}
+	}()
+	if err := loadEncryptionKeys(); err != nil {
+		return err
+	}
+	if len(encryptionKeys()) == 0 {
+		return errors.New("encryption_keyfile isn't set")
+	}
+	walPath := ""
+	if wal != nil {
+		if err := wal.reencrypt(); err != nil {
+			return err
+		}
+		walPath = wal.path
+	}
+	var bitcasks []*bitcask
+	for i := range dbs {
+		if engine, ok := dbs[i].engine.(*bitcaskEngine); ok {
+			bitcasks = append(bitcasks, engine.bc)
+		}
+	}
+	started = true
+	go func() {
+		defer rotating.Unlock()
+		rewritten, err := reencryptStorage(bitcasks, walPath)
+		if err != nil {
+			fmt.Println("WARNING: key rotation stopped after re-encrypting ", rewritten, " files: ", err)
+			return
+		}
+		fmt.Println("key rotation finished, re-encrypted", rewritten, "files")
+	}()
+	return nil
+}
+
+// reencryptStorage re-encrypts the bitcasks, then every other file in the storage path and the archive but the wal
+func reencryptStorage(bitcasks []*bitcask, walPath string) (int, error) {
+	rewritten := 0
+	for _, bc := range bitcasks {
+		count, err := bc.reencrypt()
+		rewritten += count
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	for _, root := range []string{config["database_storage_path"].(string), archivePath()} {
+		if root == "" {
+			continue
+		}
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if errors.Is(err, os.ErrNotExist) {
+				// removed since the walk started, like a deleted database
+				return nil
+			}
+			if err != nil || info.IsDir() || path == walPath {
+				return err
+			}
+			// a save can't replace the file between reading and rewriting it
+			storageLock.Lock()
+			changed, err := reencryptFile(path)
+			storageLock.Unlock()
+			if changed {
+				rewritten++
+			}
+			return err
+		})
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+// reencryptFile seals a whole file (or the records of a wal archive) with the current key, if it isn't already
+// old text format databases are sealed as they are, bitcask data and hint files are left to their bitcask
+func reencryptFile(path string) (bool, error) {
+	if strings.HasSuffix(path, ".tmp") || strings.HasSuffix(path, ".data") || strings.HasSuffix(path, ".hint") {
+		return false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// an old segment or generation a save removed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if bytes.HasPrefix(data, []byte(walMagic)) {
+		return true, rewriteWAL(path)
+	}
+	if isSealedFile(data) {
+		if len(data) >= len(sealedMagic)+2 && sealedWithCurrentKey(data[len(sealedMagic)+2:]) {
+			return false, nil
+		}
+		if data, err = unsealFile(data); err != nil {
+			return false, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if _, legacy := legacyDatabaseName(filepath.Base(path)); !legacy && !isWholeFileFormat(data) {
+		// not ours
+		return false, nil
+	}
+	return true, writeFileAtomic(path, 0, func(w *bufio.Writer) error {
+		_, err := w.Write(sealFile(data))
+		return err
+	})
+}
+
+func isWholeFileFormat(data []byte) bool {
+	for _, magic := range []string{formatMagic, manifestMagic, hintMagic, backupMagic, gzipMagic} {
+		if bytes.HasPrefix(data, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteWAL writes every record of a wal file again, which seals them with the current key
+func rewriteWAL(path string) error {
+	mutations, err := readWAL(path)
+	if err != nil {
+		return err
+	}
+	out := walHeader()
+	for _, m := range mutations {
+		out = append(out, encodeMutation(m)...)
+	}
+	return writeFileAtomic(path, 0, func(w *bufio.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
+
+// reencrypt rewrites the open wal with the current key
+func (w *writeAheadLog) reencrypt() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	err := rewriteWAL(w.path)
+	file, openErr := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	w.file = file
+	return err
+}
+
+// reencrypt starts a new active file, then compacts the old ones, which writes every record in them again with the current key
+// records written before encryption was turned on get bigger when they're sealed, so they can't be sealed in place
+func (bc *bitcask) reencrypt() (int, error) {
+	bc.mu.Lock()
+	err := bc.rotate()
+	activeID := bc.activeID
+	bc.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	ids, err := bitcaskFileIDs(bc.dir)
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, id := range ids {
+		if id < activeID {
+			rewritten++
+		}
+	}
+	// the file that was active until now is new to compaction, so it always merges
+	return rewritten, bc.compact()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	oldTestKey = strings.Repeat("11", 32)
+	newTestKey = strings.Repeat("22", 32)
+)
+
+// useKeys writes a keyfile with the given keys and turns encryption on with it, it's turned off again after the test
+func useKeys(t *testing.T, keys ...string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(strings.Join(keys, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config["encryption_keyfile"] = path
+	if err := loadEncryptionKeys(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { keyring.Store([]encryptionKey(nil)) })
+}
+
+// storedPlainly returns every file in the storage path that has secret in it as it is
+func storedPlainly(t *testing.T, secret string) []string {
+	t.Helper()
+	var found []string
+	err := filepath.Walk(config["database_storage_path"].(string), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if bytes.Contains(data, []byte(secret)) {
+			found = append(found, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// openAll opens every database on disk and loads its tables, then reads the wal, returning the first error
+func openAll() error {
+	names, err := databaseNames(config["database_storage_path"].(string))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		db, err := openDatabase(name)
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, db)
+		for i := range db.Tables {
+			if err := db.Tables[i].load(); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = readWAL(walPathFromConfig())
+	return err
+}
+
+// rotateTestKey rotates the key and waits for the rotation to finish in the background
+func rotateTestKey(t *testing.T, ctx *Context) {
+	t.Helper()
+	runCommand(t, ctx, `tell database to rotate key`)
+	rotating.Lock()
+	rotating.Unlock()
+}
+
+// with a keyfile nothing written to disk has the data in it, it comes back with the key and not without it
+func TestEncryptedStorage(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			useKeys(t, oldTestKey)
+			runCommand(t, ctx, `tell entry to create saved,"attack at dawn"`)
+			saveDatabases(true)
+			runCommand(t, ctx, `tell entry to create logged,"attack at dusk"`)
+			for _, secret := range []string{"attack at dawn", "attack at dusk"} {
+				if found := storedPlainly(t, secret); len(found) > 0 {
+					t.Fatalf("%q is in %v unencrypted", secret, found)
+				}
+			}
+
+			ctx = crashTestServer(t)
+			if got := runCommand(t, ctx, `tell entry to present saved`); got != `"attack at dawn"` {
+				t.Fatalf("saved is %s after the crash", got)
+			}
+			if got := runCommand(t, ctx, `tell entry to present logged`); got != `"attack at dusk"` {
+				t.Fatalf("logged is %s after the crash", got)
+			}
+
+			stopTestServer()
+			keyring.Store([]encryptionKey(nil))
+			if err := openAll(); err == nil {
+				t.Fatal("read the databases without a key")
+			}
+			stopTestServer()
+			useKeys(t, newTestKey)
+			if err := openAll(); err == nil {
+				t.Fatal("read the databases with the wrong key")
+			}
+		})
+	}
+}
+
+// after rotating, everything on disk is readable with only the new key
+func TestRotateKey(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			useKeys(t, oldTestKey)
+			if engine == "bitcask" {
+				// every record gets a file of its own, so there are immutable files and hints to re-encrypt
+				findDatabase("app").engine.(*bitcaskEngine).bc.maxFileSize = 1
+			}
+			runCommand(t, ctx, `tell entry to create saved,1`)
+			saveDatabases(true)
+			runCommand(t, ctx, `tell entry to create logged,2`)
+
+			useKeys(t, newTestKey, oldTestKey)
+			rotateTestKey(t, ctx)
+			useKeys(t, newTestKey)
+			ctx = crashTestServer(t)
+			for key, want := range map[string]string{"saved": "1", "logged": "2"} {
+				if got := runCommand(t, ctx, `tell entry to present `+key); got != want {
+					t.Fatalf("%s is %s after rotating, want %s", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// turning encryption on and rotating encrypts what was written before, bitcask records and old text format files included
+func TestRotateEncryptsOldData(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			if engine == "bitcask" {
+				findDatabase("app").engine.(*bitcaskEngine).bc.maxFileSize = 1
+			}
+			runCommand(t, ctx, `tell entry to create saved,"attack at dawn"`)
+			saveDatabases(true)
+			runCommand(t, ctx, `tell entry to create logged,"attack at dusk"`)
+			// a database still in the old text format, it's only rewritten in the new format once it changes
+			legacy := filepath.Join(config["database_storage_path"].(string), "old.db")
+			if err := os.WriteFile(legacy, []byte("t:\nk:attack at noon\n\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			useKeys(t, newTestKey)
+			rotateTestKey(t, ctx)
+			for _, secret := range []string{"attack at dawn", "attack at dusk", "attack at noon"} {
+				if found := storedPlainly(t, secret); len(found) > 0 {
+					t.Errorf("%q is still in %v unencrypted after rotating", secret, found)
+				}
+			}
+			ctx = crashTestServer(t)
+			for key, want := range map[string]string{"saved": `"attack at dawn"`, "logged": `"attack at dusk"`} {
+				if got := runCommand(t, ctx, `tell entry to present `+key); got != want {
+					t.Errorf("%s is %s after rotating, want %s", key, got, want)
+				}
+			}
+			old, err := loadDB(legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries := old.Tables[0].entries(); len(entries) != 1 || entries[0].Value != "attack at noon" {
+				t.Errorf("the old text format database has %+v after rotating", entries)
+			}
+		})
+	}
+}
+
+// a rotation doesn't hold up other demands, and a second one waits for the first to finish
+func TestRotateKeyRunsInTheBackground(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	useKeys(t, newTestKey)
+	rotating.Lock()
+	if _, err := tryCommand(ctx, `tell database to rotate key`); err == nil {
+		t.Fatal("a second rotation started while one was running")
+	}
+	rotating.Unlock()
+	storageLock.Lock()
+	done := make(chan error)
+	go func() {
+		// the background half of the rotation waits for the save that holds storageLock
+		_, err := tryCommand(ctx, `tell database to rotate key`)
+		done <- err
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	runCommand(t, ctx, `tell entry to create k,1`)
+	storageLock.Unlock()
+	rotating.Lock()
+	rotating.Unlock()
+}
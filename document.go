@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+json documents
+json"{\"name\": \"Ada\", \"address\": {\"city\": \"London\"}}" is a document literal, it has to be valid json
+tell entry to present k at .address.city reads part of a document, tell entry to become k at .address.city,"Oslo" changes it
+(missing objects on the way are created), tell entry to present where path .address.city is "Oslo" finds documents by what's in them,
+between <low> and <high> and starts with <prefix> work too
+a path is . for the whole document, then .field and [index] as many times as needed
+numbers come out as ints if they're whole, objects and arrays come out as documents
+on disk a document is a tree of nodes (see appendNode), not its text
+*/
+
+// Document is a json value, its node is nil, bool, json.Number, string, []interface{} or map[string]interface{}
+type Document struct {
+	node interface{}
+}
+
+// document node tags
+const (
+	nodeNull byte = iota
+	nodeFalse
+	nodeTrue
+	nodeNumber
+	nodeString
+	nodeArray
+	nodeObject
+)
+
+// parseDocument parses json text into a document
+func parseDocument(text string) (Document, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var node interface{}
+	if err := decoder.Decode(&node); err != nil {
+		return Document{}, fmt.Errorf("bad json: %v", err)
+	}
+	if decoder.More() {
+		return Document{}, errors.New("bad json: more than one value")
+	}
+	return Document{node: node}, nil
+}
+
+func (doc Document) String() string {
+	text, err := json.Marshal(doc.node)
+	if err != nil {
+		return fmt.Sprintf("%v", doc.node)
+	}
+	return string(text)
+}
+
+func appendNode(buf []byte, node interface{}) []byte {
+	switch n := node.(type) {
+	case nil:
+		return append(buf, nodeNull)
+	case bool:
+		if n {
+			return append(buf, nodeTrue)
+		}
+		return append(buf, nodeFalse)
+	case json.Number:
+		return appendString(append(buf, nodeNumber), string(n))
+	case string:
+		return appendString(append(buf, nodeString), n)
+	case []interface{}:
+		buf = appendUint32(append(buf, nodeArray), uint32(len(n)))
+		for _, element := range n {
+			buf = appendNode(buf, element)
+		}
+		return buf
+	case map[string]interface{}:
+		// fields are written in order so the same document is always the same bytes
+		fields := make([]string, 0, len(n))
+		for field := range n {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		buf = appendUint32(append(buf, nodeObject), uint32(len(n)))
+		for _, field := range fields {
+			buf = appendString(buf, field)
+			buf = appendNode(buf, n[field])
+		}
+		return buf
+	}
+	// shouldn't happen, nodes only come from parseDocument and valueToNode
+	return appendString(append(buf, nodeString), fmt.Sprintf("%v", node))
+}
+
+func readNode(buf []byte) (interface{}, []byte, error) {
+	if len(buf) < 1 {
+		return nil, nil, errors.New("record is truncated")
+	}
+	tag := buf[0]
+	buf = buf[1:]
+	switch tag {
+	case nodeNull:
+		return nil, buf, nil
+	case nodeFalse, nodeTrue:
+		return tag == nodeTrue, buf, nil
+	case nodeNumber:
+		s, rest, err := readString(buf)
+		return json.Number(s), rest, err
+	case nodeString:
+		return readString(buf)
+	case nodeArray, nodeObject:
+		count, rest, err := readUint32(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		// every node takes at least its tag byte
+		if int(count) > len(rest) {
+			return nil, nil, errors.New("record is truncated")
+		}
+		if tag == nodeArray {
+			array := make([]interface{}, count)
+			for i := range array {
+				if array[i], rest, err = readNode(rest); err != nil {
+					return nil, nil, err
+				}
+			}
+			return array, rest, nil
+		}
+		object := make(map[string]interface{}, count)
+		for i := uint32(0); i < count; i++ {
+			var field string
+			if field, rest, err = readString(rest); err != nil {
+				return nil, nil, err
+			}
+			if object[field], rest, err = readNode(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		return object, rest, nil
+	}
+	return nil, nil, fmt.Errorf("unknown document node %d", tag)
+}
+
+// nodeToValue turns a node into a value, whole numbers become ints and objects and arrays stay documents
+func nodeToValue(node interface{}) interface{} {
+	switch n := node.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	case []interface{}, map[string]interface{}:
+		return Document{node: n}
+	}
+	return node
+}
+
+// valueToNode is the opposite of nodeToValue, timestamps become strings
+func valueToNode(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case nil, bool, string:
+		return n, nil
+	case int64:
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, errors.New("json has no NaN or infinity")
+		}
+		return json.Number(strconv.FormatFloat(n, 'g', -1, 64)), nil
+	case time.Time:
+		return n.Format(time.RFC3339Nano), nil
+	case Document:
+		return n.node, nil
+	case List:
+		array := make([]interface{}, len(n))
+		for i, element := range n {
+			var err error
+			if array[i], err = valueToNode(element); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	case Set:
+		return valueToNode(List(n.members()))
+	}
+	return nil, fmt.Errorf("%T can't go into a document", v)
+}
+
+// parsePath parses .field.other[2].more into its steps, field names are strings and indexes are ints
+func parsePath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, ".") {
+		return nil, fmt.Errorf("path %s should start with .", path)
+	}
+	if path == "." {
+		return nil, nil
+	}
+	var steps []interface{}
+	for rest := path; rest != ""; {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			field := rest[1 : end+1]
+			if field == "" {
+				return nil, fmt.Errorf("path %s has an empty field name", path)
+			}
+			steps = append(steps, field)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("path %s has an unclosed [", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("path %s has a bad index %s", path, rest[1:end])
+			}
+			steps = append(steps, index)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %s: expected . or [ at %s", path, rest)
+		}
+	}
+	return steps, nil
+}
+
+// lookupPath returns the node at path, false if there's nothing there
+func (doc Document) lookupPath(steps []interface{}) (interface{}, bool) {
+	node := doc.node
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			object, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if node, ok = object[step]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := node.([]interface{})
+			if !ok || step >= len(array) {
+				return nil, false
+			}
+			node = array[step]
+		}
+	}
+	return node, true
+}
+
+// setPath returns a copy of doc with the node at path set to value
+// only the objects and arrays along the path are copied, the old document is never changed
+// missing fields along the way are created as objects, array indexes have to exist already (or be one past the end)
+func (doc Document) setPath(steps []interface{}, value interface{}) (Document, error) {
+	node, err := valueToNode(value)
+	if err != nil {
+		return Document{}, err
+	}
+	root, err := setNode(doc.node, steps, node)
+	if err != nil {
+		return Document{}, err
+	}
+	return Document{node: root}, nil
+}
+
+func setNode(node interface{}, steps []interface{}, value interface{}) (interface{}, error) {
+	if len(steps) == 0 {
+		return value, nil
+	}
+	switch step := steps[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		if !ok && node != nil {
+			return nil, fmt.Errorf("can't set field %s of something that isn't an object", step)
+		}
+		changed := make(map[string]interface{}, len(object)+1)
+		for field, v := range object {
+			changed[field] = v
+		}
+		child, err := setNode(object[step], steps[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		changed[step] = child
+		return changed, nil
+	case int:
+		array, ok := node.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can't set index %d of something that isn't an array", step)
+		}
+		if step > len(array) {
+			return nil, fmt.Errorf("index %d is past the end of the array", step)
+		}
+		changed := append(make([]interface{}, 0, len(array)+1), array...)
+		var current interface{}
+		if step == len(array) {
+			changed = append(changed, nil)
+		} else {
+			current = array[step]
+		}
+		child, err := setNode(current, steps[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		changed[step] = child
+		return changed, nil
+	}
+	return nil, errors.New("bad path")
+}
+
+// equalDocuments is true if both documents hold the same json
+func equalDocuments(a Document, b Document) bool {
+	return bytes.Equal(appendNode(nil, a.node), appendNode(nil, b.node))
+}
+
+// keysWithPath returns the keys of documents whose value at path matches the filter (see columnMatches)
+func (tb *Table) keysWithPath(steps []interface{}, op string, a interface{}, b interface{}) []interface{} {
+	var keys []interface{}
+	for _, entry := range tb.entries() {
+		doc, ok := entry.Value.(Document)
+		if !ok {
+			continue
+		}
+		node, ok := doc.lookupPath(steps)
+		if !ok {
+			continue
+		}
+		value := nodeToValue(node)
+		if sub, ok := value.(Document); ok {
+			if other, ok := a.(Document); ok && op == "is" && equalDocuments(sub, other) {
+				keys = append(keys, entry.Key)
+			}
+			continue
+		}
+		if columnMatches(value, op, a, b) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	sortValues(keys)
+	return keys
+}
+
+func (ctx *Context) getPath(key interface{}, path string) (interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key)
+	if entry == nil {
+		return nil, nil
+	}
+	doc, ok := entry.Value.(Document)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a document", formatValue(key))
+	}
+	node, ok := doc.lookupPath(steps)
+	if !ok {
+		return nil, nil
+	}
+	return nodeToValue(node), nil
+}
+
+// setPath changes part of a document
+func (ctx *Context) setPath(key interface{}, path string, value interface{}) error {
+	// make sure user has write permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermWrite {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	steps, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	entry := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key)
+	if entry == nil {
+		return errors.New("key not found")
+	}
+	doc, ok := entry.Value.(Document)
+	if !ok {
+		return fmt.Errorf("%s is not a document", formatValue(key))
+	}
+	// make sure it applies before it goes into the wal
+	if _, err := doc.setPath(steps, value); err != nil {
+		return err
+	}
+	return commitMutation(mutation{
+		Op:       walOpSetPath,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+		Key:      key,
+		Value:    Record{path, value},
+		User:     ctx.UserInUse,
+	})
+}
+
+func (ctx *Context) getEntryKeysWithPath(path string, op string, a interface{}, b interface{}) ([]interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].keysWithPath(steps, op, a, b), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDocumentPaths(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			runCommand(t, ctx, `tell entry to create ada,json"{\"name\": \"Ada\", \"address\": {\"city\": \"London\"}, \"langs\": [\"en\", \"fr\"], \"age\": 36}"`)
+			runCommand(t, ctx, `tell entry to create bob,json"{\"name\": \"Bob\", \"address\": {\"city\": \"Oslo\"}, \"age\": 40.5}"`)
+			runCommand(t, ctx, `tell entry to create plain,1`)
+			for _, command := range []string{
+				`tell entry to create bad,json"{nope"`,
+				`tell entry to present plain at .x`,
+				`tell entry to become plain at .x,1`,
+			} {
+				if _, err := tryCommand(ctx, command); err == nil {
+					t.Errorf("%s worked", command)
+				}
+			}
+			// missing objects on the way are created
+			runCommand(t, ctx, `tell entry to become ada at .address.city,"Paris"`)
+			runCommand(t, ctx, `tell entry to become ada at .job.title,"countess"`)
+
+			check := func(when string) {
+				t.Helper()
+				for command, want := range map[string]string{
+					`tell entry to present ada at .address.city`:               `"Paris"`,
+					`tell entry to present ada at .job.title`:                  `"countess"`,
+					`tell entry to present ada at .langs[1]`:                   `"fr"`,
+					`tell entry to present ada at .address`:                    `json"{\"city\":\"Paris\"}"`,
+					`tell entry to present ada at .age`:                        `36`,
+					`tell entry to present bob at .age`:                        `40.5`,
+					`tell entry to present ada at .missing`:                    `null`,
+					`tell entry to present ada at .langs[5]`:                   `null`,
+					`tell entry to present where path .address.city is "Oslo"`: `["bob"]`,
+					`tell entry to present where path .age between 30 and 40`:  `["ada"]`,
+					`tell entry to present where path .name starts with B`:     `["bob"]`,
+				} {
+					if got := runCommand(t, ctx, command); got != want {
+						t.Errorf("%s: %s is %s, want %s", when, command, got, want)
+					}
+				}
+			}
+			check("while running")
+			saveDatabases(true)
+			ctx = crashTestServer(t)
+			check("after a restart")
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+entry expiry
+tell entry to create k,v expire in 30m creates an entry that goes away after 30 minutes,
+tell entry to expire k in 1h sets (or moves) the deadline of an existing entry, tell entry to expire k never clears it
+tell entry to present ttl k shows how long an entry has left
+the deadline is kept with the entry (as unix nanoseconds) and goes through the wal like any other change,
+an entry created with a deadline is one add with the deadline in it
+expired entries are never returned, the main loop deletes them in the background
+*/
+
+// expired is true if the entry has a deadline and it has passed
+func (entry *Entry) expired(now int64) bool {
+	return entry.expires != 0 && entry.expires <= now
+}
+
+// parseTTL parses a duration like 30s, 15m or 1h30m
+func parseTTL(s string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(parseStringLiteral(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad duration %s, use something like 30s, 15m or 1h30m", s)
+	}
+	if ttl <= 0 {
+		return 0, errors.New("the duration has to be positive")
+	}
+	return ttl, nil
+}
+
+// expireEntry sets the deadline of an entry, a nil deadline clears it
+func (tb *Table) expireEntry(key interface{}, deadline interface{}) {
+	i, ok := tb.lookup(key)
+	if !ok {
+		return
+	}
+	if tb.Data[i].expires != 0 {
+		tb.expiring--
+	}
+	tb.Data[i].expires = 0
+	if t, ok := deadline.(time.Time); ok {
+		tb.Data[i].expires = t.UnixNano()
+		tb.expiring++
+	}
+}
+
+// hasExpired is true if key is in the table but its entry has expired
+func (tb *Table) hasExpired(key interface{}) bool {
+	i, ok := tb.lookup(key)
+	return ok && tb.Data[i].expired(time.Now().UnixNano())
+}
+
+// withoutExpired drops the keys of expired entries from keys
+func (tb *Table) withoutExpired(keys []interface{}) []interface{} {
+	if tb.expiring == 0 {
+		return keys
+	}
+	live := keys[:0:0]
+	for _, key := range keys {
+		if !tb.hasExpired(key) {
+			live = append(live, key)
+		}
+	}
+	return live
+}
+
+// expiredKeys returns the keys of every entry whose deadline has passed
+func (tb *Table) expiredKeys() []interface{} {
+	if tb.lazy != nil {
+		return nil
+	}
+	tb.ensureIndexed()
+	if tb.expiring == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	var keys []interface{}
+	for i := range tb.Data {
+		if !tb.Data[i].deleted && tb.Data[i].expired(now) {
+			if j, ok := tb.lookup(tb.Data[i].Key); ok && j == i {
+				keys = append(keys, tb.Data[i].Key)
+			}
+		}
+	}
+	return keys
+}
+
+// expireEntries deletes every expired entry, the main loop calls it every second
+// tables that haven't been loaded yet are left alone, their expired entries are hidden until they're loaded
+func expireEntries() {
+	for i := range dbs {
+		for j := range dbs[i].Tables {
+			for _, key := range dbs[i].Tables[j].expiredKeys() {
+				err := commitMutation(mutation{
+					Op:       walOpDeleteEntry,
+					Database: dbs[i].Name,
+					Table:    dbs[i].Tables[j].Name,
+					Key:      key,
+				})
+				if err != nil {
+					fmt.Println("WARNING: could not delete expired entry: ", err)
+				}
+			}
+		}
+	}
+}
+
+func (ctx *Context) expireEntry(key interface{}, ttl time.Duration) error {
+	// make sure user has write permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermWrite {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	if dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key) == nil {
+		return errors.New("key not found")
+	}
+	// a ttl of 0 clears the deadline
+	var deadline interface{}
+	if ttl > 0 {
+		deadline = time.Now().Add(ttl).UTC()
+	}
+	return commitMutation(mutation{
+		Op:       walOpExpireEntry,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+		Key:      key,
+		Value:    deadline,
+	})
+}
+
+// getTTL returns how long an entry has left, nil if it doesn't expire
+func (ctx *Context) getTTL(key interface{}) (interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	entry := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key)
+	if entry == nil {
+		return nil, errors.New("key not found")
+	}
+	if entry.expires == 0 {
+		return nil, nil
+	}
+	return time.Until(time.Unix(0, entry.expires)).Round(time.Millisecond), nil
+}
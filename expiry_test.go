@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+// an entry created with a ttl goes into the wal and the engine as one add, so a crash can't keep it without its deadline
+func TestCreateWithTTLIsOneWrite(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			if engine == "bitcask" {
+				// every record gets a file of its own, so compaction has something to merge
+				findDatabase("app").engine.(*bitcaskEngine).bc.maxFileSize = 1
+			}
+			runCommand(t, ctx, `tell entry to create k,1 expire in 1h`)
+			mutations, err := readWAL(walPathFromConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var writes []mutation
+			for _, m := range mutations {
+				if m.Key == "k" {
+					writes = append(writes, m)
+				}
+			}
+			if len(writes) != 1 || writes[0].Op != walOpAddEntry || writes[0].Expires == 0 {
+				t.Fatalf("creating k wrote %+v, want one add with a deadline", writes)
+			}
+			runCommand(t, ctx, `tell entry to become k,2`)
+			if engine == "bitcask" {
+				if err := findDatabase("app").engine.(*bitcaskEngine).bc.compact(); err != nil {
+					t.Fatal(err)
+				}
+				// the bitcask has everything, the wal isn't needed to get it back
+				saveDatabases(true)
+			}
+
+			ctx = crashTestServer(t)
+			if got := runCommand(t, ctx, `tell entry to present k`); got != "2" {
+				t.Fatalf("k is %s after the crash, want 2", got)
+			}
+			if got := runCommand(t, ctx, `tell entry to present ttl k`); got == "null" {
+				t.Fatal("k lost its deadline in the crash")
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+/*
+on-disk format
+header:  "FUQLDB" | version (uint16) | table count (uint32) | crc32 of the above
+table:   payload length (uint32) | payload | crc32 of payload
+payload: name | flags (byte) | [schema] | entry count (uint32) | key, value, [expires], [version], [metadata], key, value, ...
+schema:  column count (uint32) | name, kind (byte), name, kind, ... (only if the schema flag is set)
+expires: unix nanoseconds (uint64), 0 if the entry doesn't expire (only if the expiry flag is set)
+version: the entry's version (uint64, only if the versions flag is set, otherwise every entry is at version 1)
+metadata: created (uint64), updated (uint64), writer (only if the metadata flag is set)
+keys and values are typed (see values.go), strings are a uint32 length followed by the bytes, everything is big endian
+files without the magic are the old text format, they get rewritten in this one on the next save,
+their keys are parsed like literals when they're read (see legacyKey), their values stay strings
+*/
+
+const formatMagic = "FUQLDB"
+
+const formatVersion uint16 = 1
+
+// table flags
+const (
+	tableFlagValueIndex byte = 1
+	tableFlagSchema     byte = 2
+	tableFlagExpiry     byte = 4
+	tableFlagVersions   byte = 8
+	tableFlagMetadata   byte = 16
+)
+
+func appendUint16(buf []byte, n uint16) []byte {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], n)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], n)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], n)
+	return append(buf, tmp[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func readUint32(buf []byte) (uint32, []byte, error) {
+	if len(buf) < 4 {
+		return 0, nil, errors.New("record is truncated")
+	}
+	return binary.BigEndian.Uint32(buf), buf[4:], nil
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	length, buf, err := readUint32(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint32(len(buf)) < length {
+		return "", nil, errors.New("record is truncated")
+	}
+	return string(buf[:length]), buf[length:], nil
+}
+
+// appendSection appends payload with its length and checksum
+func appendSection(buf []byte, payload []byte) []byte {
+	buf = appendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	return appendUint32(buf, crc32.ChecksumIEEE(payload))
+}
+
+// readSection is the opposite of appendSection, it fails if the checksum doesn't match
+func readSection(buf []byte) ([]byte, []byte, error) {
+	length, buf, err := readUint32(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(buf)) < length+4 {
+		return nil, nil, errors.New("section is truncated")
+	}
+	payload := buf[:length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[length:]) {
+		return nil, nil, errors.New("section checksum mismatch")
+	}
+	return payload, buf[length+4:], nil
+}
+
+func isBinaryFormat(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(formatMagic))
+}
+
+func encodeTable(table Table) []byte {
+	payload := appendString(nil, table.Name)
+	var flags byte
+	if table.values != nil {
+		flags |= tableFlagValueIndex
+	}
+	if table.schema != nil {
+		flags |= tableFlagSchema
+	}
+	entries := table.entries()
+	for _, entry := range entries {
+		if entry.expires != 0 {
+			flags |= tableFlagExpiry
+		}
+		if entry.version > 1 {
+			flags |= tableFlagVersions
+		}
+		if entry.updated != 0 {
+			flags |= tableFlagMetadata
+		}
+	}
+	payload = append(payload, flags)
+	if table.schema != nil {
+		payload = appendUint32(payload, uint32(len(table.schema)))
+		for _, column := range table.schema {
+			payload = appendString(payload, column.Name)
+			payload = append(payload, byte(column.Kind))
+		}
+	}
+	payload = appendUint32(payload, uint32(len(entries)))
+	for _, entry := range entries {
+		payload = appendValue(payload, entry.Key)
+		payload = appendValue(payload, entry.Value)
+		if flags&tableFlagExpiry != 0 {
+			payload = appendUint64(payload, uint64(entry.expires))
+		}
+		if flags&tableFlagVersions != 0 {
+			payload = appendUint64(payload, entry.version)
+		}
+		if flags&tableFlagMetadata != 0 {
+			payload = appendUint64(payload, uint64(entry.created))
+			payload = appendUint64(payload, uint64(entry.updated))
+			payload = appendString(payload, entry.writer)
+		}
+	}
+	return payload
+}
+
+func decodeTable(payload []byte) (Table, error) {
+	var table Table
+	var err error
+	var count uint32
+	if table.Name, payload, err = readString(payload); err != nil {
+		return table, err
+	}
+	if len(payload) < 1 {
+		return table, errors.New("record is truncated")
+	}
+	flags, payload := payload[0], payload[1:]
+	if flags&tableFlagSchema != 0 {
+		var columns uint32
+		if columns, payload, err = readUint32(payload); err != nil {
+			return table, err
+		}
+		for i := uint32(0); i < columns; i++ {
+			var column Column
+			if column.Name, payload, err = readString(payload); err != nil {
+				return table, err
+			}
+			if len(payload) < 1 {
+				return table, errors.New("record is truncated")
+			}
+			column.Kind, payload = ValueKind(payload[0]), payload[1:]
+			table.schema = append(table.schema, column)
+		}
+	}
+	if count, payload, err = readUint32(payload); err != nil {
+		return table, err
+	}
+	for i := uint32(0); i < count; i++ {
+		var key, value interface{}
+		if key, payload, err = readValue(payload); err != nil {
+			return table, err
+		}
+		if value, payload, err = readValue(payload); err != nil {
+			return table, err
+		}
+		table.addEntry(key, value)
+		if flags&tableFlagExpiry != 0 {
+			var expires uint64
+			if expires, payload, err = readUint64(payload); err != nil {
+				return table, err
+			}
+			table.Data[len(table.Data)-1].expires = int64(expires)
+		}
+		if flags&tableFlagVersions != 0 {
+			var version uint64
+			if version, payload, err = readUint64(payload); err != nil {
+				return table, err
+			}
+			table.Data[len(table.Data)-1].version = version
+		}
+		if flags&tableFlagMetadata != 0 {
+			var created, updated uint64
+			var writer string
+			if created, payload, err = readUint64(payload); err != nil {
+				return table, err
+			}
+			if updated, payload, err = readUint64(payload); err != nil {
+				return table, err
+			}
+			if writer, payload, err = readString(payload); err != nil {
+				return table, err
+			}
+			entry := &table.Data[len(table.Data)-1]
+			entry.created, entry.updated, entry.writer = int64(created), int64(updated), writer
+		}
+	}
+	if len(payload) != 0 {
+		return table, errors.New("trailing bytes after the last entry")
+	}
+	if flags&tableFlagValueIndex != 0 {
+		table.indexValues()
+	} else if flags&tableFlagExpiry != 0 {
+		// counts the entries that expire
+		table.reindex()
+	}
+	return table, nil
+}
+
+func serializeDB(db Database) []byte {
+	header := []byte(formatMagic)
+	header = appendUint16(header, formatVersion)
+	header = appendUint32(header, uint32(len(db.Tables)))
+	out := appendUint32(header, crc32.ChecksumIEEE(header))
+	for _, table := range db.Tables {
+		out = appendSection(out, encodeTable(table))
+	}
+	return out
+}
+
+func decodeDB(data []byte) (Database, error) {
+	var db Database
+	headerLength := len(formatMagic) + 2 + 4
+	if len(data) < headerLength+4 {
+		return db, errors.New("header is truncated")
+	}
+	header := data[:headerLength]
+	if crc32.ChecksumIEEE(header) != binary.BigEndian.Uint32(data[headerLength:]) {
+		return db, errors.New("header checksum mismatch")
+	}
+	version := binary.BigEndian.Uint16(header[len(formatMagic):])
+	if version != formatVersion {
+		return db, fmt.Errorf("unsupported format version %d", version)
+	}
+	count := binary.BigEndian.Uint32(header[len(formatMagic)+2:])
+	rest := data[headerLength+4:]
+	for i := uint32(0); i < count; i++ {
+		payload, next, err := readSection(rest)
+		if err != nil {
+			return db, fmt.Errorf("table %d: %v", i, err)
+		}
+		table, err := decodeTable(payload)
+		if err != nil {
+			return db, fmt.Errorf("table %d: %v", i, err)
+		}
+		db.Tables = append(db.Tables, table)
+		rest = next
+	}
+	if len(rest) != 0 {
+		return db, errors.New("trailing bytes after the last table")
+	}
+	return db, nil
+}
+
+// splitEscaped splits line on the first : that isn't escaped with a \
+func splitEscaped(line string) (string, string, bool) {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) && line[i+1] == ':' {
+			i++
+			continue
+		}
+		if line[i] == ':' {
+			return line[:i], line[i+1:], true
+		}
+	}
+	return line, "", false
+}
+
+func unescapeLegacy(s string) string {
+	return strings.Replace(s, "\\:", ":", -1)
+}
+
+// decodeLegacyDB reads the old text format
+// a table is its name followed by a :, then a key:value line per entry, then an empty line
+func decodeLegacyDB(data []byte) (Database, error) {
+	return scanLegacyDB(data, func(lineNumber int, problem string) error {
+		return fmt.Errorf("line %d: %s", lineNumber, problem)
+	})
+}
+
+// scanLegacyDB reads the old text format, calling bad with every line it can't make sense of
+// reading stops with bad's error, if bad returns nil the line is skipped
+func scanLegacyDB(data []byte, bad func(lineNumber int, problem string) error) (Database, error) {
+	var db Database
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	var table *Table
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if table == nil {
+			if line == "" {
+				continue
+			}
+			name, rest, ok := splitEscaped(line)
+			if !ok || rest != "" {
+				if err := bad(lineNumber, "expected a table name"); err != nil {
+					return db, err
+				}
+				continue
+			}
+			db.Tables = append(db.Tables, Table{Name: unescapeLegacy(name)})
+			table = &db.Tables[len(db.Tables)-1]
+			continue
+		}
+		if line == "" {
+			table = nil
+			continue
+		}
+		key, value, ok := parseLine(line)
+		if !ok {
+			if err := bad(lineNumber, "expected key:value"); err != nil {
+				return db, err
+			}
+			continue
+		}
+		table.addEntry(table.migratedKey(key), value)
+	}
+	if err := scanner.Err(); err != nil {
+		return db, fmt.Errorf("%v after line %d", err, lineNumber)
+	}
+	return db, nil
+}
+
+// migratedKey is legacyKey, unless another entry in the table already has that key, then it stays a string
+func (tb *Table) migratedKey(key string) interface{} {
+	typed := legacyKey(key)
+	if _, exists := tb.lookup(typed); exists {
+		return key
+	}
+	return typed
+}
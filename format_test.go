@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// formatTestDB has a table with every kind of value and everything a table can have, and a table with a schema
+func formatTestDB(t *testing.T) Database {
+	doc, err := parseDocument(`{"a": [1, 2.5, "x", null, true], "b": {"c": {}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var db Database
+	db.addTable("kinds")
+	kinds := &db.Tables[0]
+	at := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	for i, value := range []interface{}{
+		nil, true, int64(-7), 2.5, "text, with a comma", []byte{0, 1, 255}, at,
+		testRoot, Record{int64(1), "two"}, List{int64(1), "a"}, Set{"a": true, int64(2): true}, doc,
+	} {
+		kinds.addEntry(int64(i), value)
+	}
+	for _, key := range []interface{}{nil, false, 1.5, "key", at} {
+		kinds.addEntry(key, "other keys")
+	}
+	kinds.expireEntry(int64(1), at.Add(time.Hour))
+	kinds.changeEntry(int64(2), int64(8))
+	kinds.setMetadata(mutation{Key: int64(2), Version: 2, Created: 100, Time: 200, User: "root"})
+	kinds.indexValues()
+
+	schema, err := parseSchema("id:int,name:string,score:float")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.addTable("rows")
+	db.Tables[1].schema = schema
+	db.Tables[1].addEntry(int64(1), Record{"ada", 36.5})
+	return db
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	db := formatTestDB(t)
+	decoded, err := decodeDB(serializeDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Tables) != len(db.Tables) {
+		t.Fatalf("decoded %d tables, want %d", len(decoded.Tables), len(db.Tables))
+	}
+	for i := range db.Tables {
+		want, got := &db.Tables[i], &decoded.Tables[i]
+		if got.Name != want.Name || formatSchema(got.schema) != formatSchema(want.schema) || (got.values == nil) != (want.values == nil) {
+			t.Fatalf("table %s came back as %s with schema %q", want.Name, got.Name, formatSchema(got.schema))
+		}
+		if len(got.entries()) != len(want.entries()) {
+			t.Fatalf("table %s has %d entries, want %d", want.Name, len(got.entries()), len(want.entries()))
+		}
+		for _, entry := range want.entries() {
+			back := got.getEntry(entry.Key)
+			if back == nil {
+				t.Fatalf("table %s lost key %s", want.Name, formatValue(entry.Key))
+			}
+			if !sameValue(back.Value, entry.Value) || back.expires != entry.expires || back.version != entry.version ||
+				back.created != entry.created || back.updated != entry.updated || back.writer != entry.writer {
+				t.Errorf("table %s: %+v came back as %+v", want.Name, entry, *back)
+			}
+		}
+	}
+}
+
+func TestFormatDetectsDamage(t *testing.T) {
+	data := serializeDB(formatTestDB(t))
+	for name, damaged := range map[string][]byte{
+		"flipped byte":  append(append([]byte{}, data[:len(data)-10]...), append([]byte{data[len(data)-10] ^ 1}, data[len(data)-9:]...)...),
+		"truncated":     data[:len(data)-5],
+		"newer version": append(appendUint16([]byte(formatMagic), formatVersion+1), data[len(formatMagic)+2:]...),
+	} {
+		if _, err := decodeDB(damaged); err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
+
+// keys from the text format are read as literals, so a client finds them with the same text as before
+func TestLegacyKeysAreTyped(t *testing.T) {
+	db, err := decodeLegacyDB([]byte("t:\n42:forty-two\n3.5:x\nname:y\n\"a b\":z\na:1\n\"a\":2\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := startTestServer(t, "memory")
+	dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse] = db.Tables[0]
+	for command, want := range map[string]string{
+		`tell entry to present 42`:    `"forty-two"`,
+		`tell entry to present 3.5`:   `"x"`,
+		`tell entry to present name`:  `"y"`,
+		`tell entry to present "a b"`: `"z"`,
+		`tell entry to present a`:     `"1"`,
+	} {
+		if got := runCommand(t, ctx, command); got != want {
+			t.Errorf("%s is %s, want %s", command, got, want)
+		}
+	}
+	// a and "a" are both the string a now, the second one keeps its quotes so it isn't lost
+	if entry := db.Tables[0].getEntry(`"a"`); entry == nil || entry.Value != "2" {
+		t.Error("the colliding key \"a\" is gone")
+	}
+	if db.Tables[0].duplicates != 0 {
+		t.Errorf("%d duplicate keys after typing them", db.Tables[0].duplicates)
+	}
+}
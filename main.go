@@ -4,11 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/floppydiskette/configparser"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -32,11 +35,42 @@ type Permission int
 type Entry struct {
 	Key   interface{}
 	Value interface{}
+	// deleted entries stay in Table.Data until the table is compacted
+	deleted bool
+	// expires is when the entry expires in unix nanoseconds, 0 if it doesn't (see expiry.go)
+	expires int64
+	// version goes up by one on every change (see versions.go)
+	version uint64
+	// created and updated are in unix nanoseconds, writer is the user behind the last change, all empty if unknown (see metadata.go)
+	created int64
+	updated int64
+	writer  string
 }
 
 type Table struct {
 	Name string
 	Data []Entry
+	// index maps each key to the position of its entry in Data
+	index map[interface{}]int
+	// ordered has every key in sorted order, for range and prefix queries
+	ordered *skipList
+	// values is the secondary index on values, nil unless someone asked for it
+	values *valueIndex
+	// schema is the table's columns, nil for a plain key -> value table (see schema.go)
+	schema []Column
+	// dead is how many deleted entries are still in Data
+	dead int
+	// duplicates is how many entries were added with a key that was already there
+	duplicates int
+	// expiring is how many entries have a deadline
+	expiring int
+	// file is the segment file that has this table on disk, empty if it was never saved
+	file string
+	// dirty is true if the table changed since it was last saved
+	dirty bool
+	// lazy loads the table the first time it's used, nil once it's loaded
+	lazy    func() (Table, error)
+	loadErr error
 }
 
 type User struct {
@@ -48,9 +82,23 @@ type User struct {
 }
 
 type Database struct {
-	Name              string
-	Tables            []Table
-	timeSinceLastSave int
+	Name   string
+	Tables []Table
+	// lastSave is when the database was last written to disk
+	lastSave time.Time
+	// pendingChanges is how many changes haven't been written to disk yet
+	pendingChanges int
+	// nextSegment is the number of the next segment file written for this database
+	nextSegment uint64
+	// how many bytes the last save wrote, and how many that was before compression
+	lastSaveBytes             int64
+	lastSaveUncompressedBytes int64
+	// engine is how the database is stored (storage.go)
+	engine StorageEngine
+	// appliedUntil is the sequence number of the newest mutation the engine already has on disk, older wal records are skipped
+	appliedUntil uint64
+	// lastMutation is the sequence number of the newest mutation applied to the database, it's appliedUntil once the database is saved
+	lastMutation uint64
 }
 
 const (
@@ -70,6 +118,41 @@ const (
 	DemandDeleteDatabase
 	DemandDeleteUser
 	DemandLogin
+	DemandFindKeyRange
+	DemandFindKeyPrefix
+	DemandIndexValues
+	DemandForgetIndex
+	DemandFindValue
+	DemandFindValuePrefix
+	DemandDatabaseStatus
+	DemandBackup
+	DemandRotateKey
+	DemandCreateTableWithColumns
+	DemandFindRows
+	DemandSetColumn
+	DemandReplaceEntry
+	DemandAddExpiringEntry
+	DemandExpireEntry
+	DemandFindTTL
+	DemandIncrementEntry
+	DemandListPush
+	DemandListPop
+	DemandListIndex
+	DemandListRange
+	DemandListLength
+	DemandSetAdd
+	DemandSetRemove
+	DemandSetHas
+	DemandSetMembers
+	DemandSetSize
+	DemandSetCombine
+	DemandFindPath
+	DemandSetPath
+	DemandFindPathValue
+	DemandFindVersion
+	DemandSetEntryIf
+	DemandFindEntryWithMetadata
+	DemandFindMetadata
 
 	// internal demands
 	DemandGetContextFromUUID
@@ -100,27 +183,24 @@ type Context struct {
 
 var config map[string]interface{}
 
-const secondsBetweenAutoSave int = 60
-
 var dbs []Database
 var contexts []Context
 
-func setup() {
+func configPath() string {
 	// if os is windows, get config from C:\fuqldb\config.conf
 	// if os is linux, get config from /etc/fuqldb/config.conf
 	if os.Getenv("OS") == "Windows_NT" {
-		tmpConfig, err := configparser.LoadConfig("C:\\fuqldb\\config.conf")
-		if err != nil {
-			panic(err)
-		}
-		config = tmpConfig
-	} else {
-		tmpConfig, err := configparser.LoadConfig("/etc/fuqldb/config.conf")
-		if err != nil {
-			panic(err)
-		}
-		config = tmpConfig
+		return "C:\\fuqldb\\config.conf"
+	}
+	return "/etc/fuqldb/config.conf"
+}
+
+func loadConfig() {
+	tmpConfig, err := configparser.LoadConfig(configPath())
+	if err != nil {
+		panic(err)
 	}
+	config = tmpConfig
 
 	// make sure the config file has the right keys
 	if _, ok := config["database_storage_path"]; !ok {
@@ -132,20 +212,52 @@ func setup() {
 	if _, ok := config["sex_number"]; !ok {
 		panic("config file is missing sex_number key")
 	}
+	if err := validateEngineConfig(); err != nil {
+		panic(err)
+	}
+	if err := validateCompressionConfig(); err != nil {
+		panic(err)
+	}
+	if err := loadEncryptionKeys(); err != nil {
+		panic(err)
+	}
+}
+
+func setup() {
+	loadConfig()
 
 	// load databases from storage path
-	files, err := os.ReadDir(config["database_storage_path"].(string))
+	// each database is a directory, older versions wrote a single <name>.db file
+	storagePath := config["database_storage_path"].(string)
+	names, err := databaseNames(storagePath)
 	if err != nil {
 		panic(err)
 	}
-	for _, file := range files {
-		newDatabase, err := loadDB(file.Name())
+	for _, name := range names {
+		newDatabase, err := openDatabase(name)
 		if err != nil {
-			panic(err)
+			panic(fmt.Sprintf("could not load database %s: %v (fuqldb --check %s shows what's wrong with it)", name, err, storagePath))
 		}
-		newDatabase.timeSinceLastSave = 0
 		dbs = append(dbs, newDatabase)
 	}
+
+	// replay anything that was logged after the last save, then keep logging
+	walPath := walPathFromConfig()
+	var walPolicy walSyncPolicy = walSyncEverySecond
+	if policy, ok := config["wal_fsync"].(string); ok {
+		walPolicy, err = parseWALSyncPolicy(policy)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = replayWAL(walPath)
+	if err != nil {
+		panic(err)
+	}
+	wal, err = openWAL(walPath, walPolicy)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func initDB(name string, storagePath string, sex int) error {
@@ -172,130 +284,287 @@ func initDB(name string, storagePath string, sex int) error {
 	return nil
 }
 
-func serializeDB(db Database) string {
-	var out string
-	for _, table := range db.Tables {
-		// escape :
-		table.Name = strings.Replace(table.Name, ":", "\\:", -1)
-		out += fmt.Sprintf("%s:\n", table.Name)
-		for _, entry := range table.Data {
-			// escape :
-			key := strings.Replace(fmt.Sprintf("%v", entry.Key), ":", "\\:", -1)
-			value := strings.Replace(fmt.Sprintf("%v", entry.Value), ":", "\\:", -1)
-			out += fmt.Sprintf("%s:%s\n", key, value)
-		}
+// parseLine splits an old text format key:value line, colons escaped with \ are part of the key or value
+func parseLine(line string) (string, string, bool) {
+	key, value, ok := splitEscaped(line)
+	if !ok {
+		return "", "", false
 	}
-	return out
-}
-
-func parseLine(line string) (string, interface{}) {
-	// split on :
-	split := strings.Split(line, ":")
-	// split on \:
-	split[0] = strings.Replace(split[0], "\\:", ":", -1)
-	split[1] = strings.Replace(split[1], "\\:", ":", -1)
-	return split[0], split[1]
+	return unescapeLegacy(key), unescapeLegacy(value), true
 }
 
 func loadDB(inFile string) (Database, error) {
-	var db Database
-	file, err := os.Open(inFile)
+	if info, err := os.Stat(inFile); err == nil && info.IsDir() {
+		return loadDatabaseDir(inFile)
+	}
+	data, err := readSealedFile(inFile)
+	if err == nil {
+		data, err = decompressSnapshot(data)
+	}
 	if err != nil {
-		panic(err)
+		return Database{}, err
 	}
-	for {
-		var table Table
-		var line string
-		_, err := fmt.Fscanln(file, &line)
-		if err != nil {
-			return db, err
+	var db Database
+	if isBinaryFormat(data) {
+		db, err = decodeDB(data)
+	} else {
+		// old text format, the next save writes it back out in the binary format
+		db, err = decodeLegacyDB(data)
+		db.markDirty()
+	}
+	if err == nil {
+		reportDuplicates(inFile, db)
+	}
+	return db, err
+}
+
+// reportDuplicates warns about tables with more than one entry for a key, files written before keys had to be unique can have them
+// only the first entry for a key is used, like it always was
+func reportDuplicates(path string, db Database) {
+	for i := range db.Tables {
+		if db.Tables[i].duplicates > 0 {
+			fmt.Printf("WARNING: %s: table %s has %d entries with a duplicate key, only the first entry for a key is used (fuqldb --repair drops the rest)\n", path, db.Tables[i].Name, db.Tables[i].duplicates)
 		}
-		table.Name = line
-		for {
-			_, err := fmt.Fscanln(file, &line)
-			if err != nil {
-				return db, err
-			}
-			if line == "" {
+	}
+}
+
+func (db *Database) getTable(name string) *Table {
+	for i := range db.Tables {
+		if db.Tables[i].Name == name {
+			return &db.Tables[i]
+		}
+	}
+	return nil
+}
+
+// getEntry returns the entry for key, nil if there isn't one or it has expired
+func (tb *Table) getEntry(key interface{}) *Entry {
+	if i, ok := tb.lookup(key); ok && !tb.Data[i].expired(time.Now().UnixNano()) {
+		return &tb.Data[i]
+	}
+	return nil
+}
+
+func (tb *Table) addEntry(key interface{}, value interface{}) {
+	// look before appending, building the index afterwards would count the new entry as its own duplicate
+	_, exists := tb.lookup(key)
+	tb.Data = append(tb.Data, Entry{Key: key, Value: value, version: 1})
+	if exists {
+		// the first entry with a key wins, same as a linear scan would
+		tb.duplicates++
+		return
+	}
+	tb.index[key] = len(tb.Data) - 1
+	tb.ordered.insert(key)
+	if tb.values != nil {
+		tb.values.add(key, value)
+	}
+}
+
+func (tb *Table) tellEntryToFuckOff(key interface{}) {
+	i, ok := tb.lookup(key)
+	if !ok {
+		return
+	}
+	if tb.values != nil {
+		tb.values.remove(key, tb.Data[i].Value)
+	}
+	if tb.Data[i].expires != 0 {
+		tb.expiring--
+	}
+	tb.Data[i] = Entry{deleted: true}
+	tb.dead++
+	delete(tb.index, key)
+	if tb.duplicates > 0 {
+		// another entry with the same key is now the first one
+		for j := i + 1; j < len(tb.Data); j++ {
+			if !tb.Data[j].deleted && tb.Data[j].Key == key {
+				tb.index[key] = j
+				tb.duplicates--
+				if tb.Data[j].expires != 0 {
+					tb.expiring++
+				}
+				if tb.values != nil {
+					tb.values.add(key, tb.Data[j].Value)
+				}
 				break
 			}
-			var entry Entry
-			entry.Key, entry.Value = parseLine(line)
-			table.Data = append(table.Data, entry)
 		}
-		db.Tables = append(db.Tables, table)
 	}
-	return db, nil
+	if _, ok := tb.index[key]; !ok {
+		tb.ordered.remove(key)
+	}
+	// don't let deleted entries take up more than half the table
+	if tb.dead > len(tb.Data)/2 {
+		tb.compact()
+	}
+}
+
+func (tb *Table) changeEntry(key interface{}, value interface{}) {
+	if i, ok := tb.lookup(key); ok {
+		if tb.values != nil {
+			tb.values.remove(key, tb.Data[i].Value)
+			tb.values.add(key, value)
+		}
+		tb.Data[i].Value = value
+		tb.Data[i].version++
+	}
 }
 
-func (db *Database) saveDB(outFile string) error {
-	file, err := os.Create(outFile)
+// lookup finds the position of key in Data, building the index if the table doesn't have one yet
+func (tb *Table) lookup(key interface{}) (int, bool) {
+	tb.ensureIndexed()
+	i, ok := tb.index[key]
+	return i, ok
+}
+
+// load loads the table if it's lazy and hasn't been loaded yet
+func (tb *Table) load() error {
+	if tb.lazy == nil {
+		return nil
+	}
+	if tb.loadErr != nil {
+		return tb.loadErr
+	}
+	loaded, err := tb.lazy()
 	if err != nil {
+		fmt.Println("WARNING: ", err)
+		tb.loadErr = err
 		return err
 	}
-	for _, table := range db.Tables {
-		// escape :
-		table.Name = strings.Replace(table.Name, ":", "\\:", -1)
-		_, err := fmt.Fprintf(file, "%s:\n", table.Name)
-		if err != nil {
-			return err
+	tb.Data = loaded.Data
+	tb.values = loaded.values
+	tb.schema = loaded.schema
+	tb.dirty = tb.dirty || loaded.dirty
+	tb.index = nil
+	tb.lazy = nil
+	return nil
+}
+
+// ensureIndexed loads the table if it hasn't been yet and builds its indexes
+func (tb *Table) ensureIndexed() {
+	if tb.lazy != nil {
+		// the table stays empty if it can't be loaded, load's error shows up when something tries to change it
+		tb.load()
+	}
+	if tb.index == nil {
+		tb.reindex()
+	}
+}
+
+func (tb *Table) reindex() {
+	tb.index = make(map[interface{}]int, len(tb.Data))
+	tb.ordered = newSkipList()
+	if tb.values != nil {
+		tb.values = newValueIndex()
+	}
+	tb.dead = 0
+	tb.duplicates = 0
+	tb.expiring = 0
+	for i, entry := range tb.Data {
+		if entry.deleted {
+			tb.dead++
+			continue
 		}
-		for _, entry := range table.Data {
-			// escape :
-			key := strings.Replace(fmt.Sprintf("%v", entry.Key), ":", "\\:", -1)
-			value := strings.Replace(fmt.Sprintf("%v", entry.Value), ":", "\\:", -1)
-			_, err := fmt.Fprintf(file, "%s:%s\n", key, value)
-			if err != nil {
-				return err
-			}
+		if _, ok := tb.index[entry.Key]; ok {
+			tb.duplicates++
+			continue
 		}
-		_, err = fmt.Fprintf(file, "\n")
-		if err != nil {
-			return err
+		tb.index[entry.Key] = i
+		tb.ordered.insert(entry.Key)
+		if tb.values != nil {
+			tb.values.add(entry.Key, entry.Value)
+		}
+		if entry.expires != 0 {
+			tb.expiring++
 		}
 	}
-	return nil
 }
 
-func (db *Database) getTable(name string) *Table {
-	for _, table := range db.Tables {
-		if table.Name == name {
-			return &table
+// indexValues builds the secondary index on values, it's kept up to date from then on
+func (tb *Table) indexValues() {
+	tb.values = newValueIndex()
+	tb.reindex()
+}
+
+func (tb *Table) forgetValueIndex() {
+	tb.values = nil
+}
+
+// keysWithValue returns the keys whose value is exactly value
+func (tb *Table) keysWithValue(value interface{}) []interface{} {
+	tb.ensureIndexed()
+	if tb.values != nil && indexable(value) {
+		return tb.withoutExpired(tb.values.exact(value))
+	}
+	var keys []interface{}
+	// entries leaves out expired entries
+	for _, entry := range tb.entries() {
+		// bytes can't be compared with ==
+		if indexable(value) && entry.Value == value {
+			keys = append(keys, entry.Key)
+		} else if !indexable(value) && formatValue(entry.Value) == formatValue(value) {
+			keys = append(keys, entry.Key)
 		}
 	}
-	return nil
+	sortValues(keys)
+	return keys
 }
 
-func (tb *Table) getEntry(key interface{}) *Entry {
+// keysWithValuePrefix returns the keys whose value is a string starting with prefix
+func (tb *Table) keysWithValuePrefix(prefix string) []interface{} {
+	tb.ensureIndexed()
+	if tb.values != nil {
+		return tb.withoutExpired(tb.values.prefix(prefix))
+	}
+	var keys []interface{}
+	for _, entry := range tb.entries() {
+		if value, ok := entry.Value.(string); ok && strings.HasPrefix(value, prefix) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	sortValues(keys)
+	return keys
+}
+
+// compact drops deleted entries from Data, keeping the order of the rest
+func (tb *Table) compact() {
+	live := make([]Entry, 0, len(tb.Data)-tb.dead)
 	for _, entry := range tb.Data {
-		if entry.Key == key {
-			return &entry
+		if !entry.deleted {
+			live = append(live, entry)
 		}
 	}
-	return nil
+	tb.Data = live
+	tb.reindex()
 }
 
-func (tb *Table) addEntry(key interface{}, value interface{}) {
-	entry := Entry{Key: key, Value: value}
-	tb.Data = append(tb.Data, entry)
+// keyRange returns the keys between low and high (both included) in order
+func (tb *Table) keyRange(low interface{}, high interface{}, descending bool) []interface{} {
+	tb.ensureIndexed()
+	return tb.withoutExpired(tb.ordered.keyRange(low, high, descending))
 }
 
-func (tb *Table) tellEntryToFuckOff(key interface{}) {
-	for i, entry := range tb.Data {
-		if entry.Key == key {
-			tb.Data = append(tb.Data[:i], tb.Data[i+1:]...)
-			return
-		}
-	}
+// keysWithPrefix returns the string keys starting with prefix in order
+func (tb *Table) keysWithPrefix(prefix string, descending bool) []interface{} {
+	tb.ensureIndexed()
+	return tb.withoutExpired(tb.ordered.keysWithPrefix(prefix, descending))
 }
 
-func (tb *Table) changeEntry(key interface{}, value interface{}) {
-	for i, entry := range tb.Data {
-		if entry.Key == key {
-			tb.Data[i].Value = value
-			return
+// entries returns every entry that hasn't been deleted or expired, in the order they were added
+func (tb *Table) entries() []Entry {
+	tb.ensureIndexed()
+	if tb.dead == 0 && tb.expiring == 0 {
+		return tb.Data
+	}
+	now := time.Now().UnixNano()
+	live := make([]Entry, 0, len(tb.Data)-tb.dead)
+	for _, entry := range tb.Data {
+		if !entry.deleted && !entry.expired(now) {
+			live = append(live, entry)
 		}
 	}
+	return live
 }
 
 func (db *Database) addTable(name string) {
@@ -346,6 +615,19 @@ func (ctx *Context) getDB(name string) *Database {
 	return nil
 }
 
+// userEntry finds the user in use for the database in use, without needing read permission like getDB does
+func (ctx *Context) userEntry() *Entry {
+	for i := range dbs {
+		if dbs[i].Name == "users" {
+			if table := dbs[i].getTable(dbs[ctx.DatabaseInUse].Name); table != nil {
+				return table.getEntry(ctx.UserInUse)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
 func (ctx *Context) getTable(dbName string, tableName string) *Table {
 	// make sure user has read permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
@@ -391,11 +673,17 @@ func (ctx *Context) getEntry(key interface{}) *Entry {
 	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key)
 }
 
-func (ctx *Context) addEntry(key interface{}, value interface{}) {
+func (ctx *Context) addEntry(key interface{}, value interface{}) error {
+	return ctx.addExpiringEntry(key, value, 0)
+}
+
+// addExpiringEntry is addEntry for an entry that expires after ttl (never if it's 0),
+// the deadline goes into the same mutation as the entry so a crash can't leave one without the other
+func (ctx *Context) addExpiringEntry(key interface{}, value interface{}, ttl time.Duration) error {
 	// make sure user has write permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
@@ -405,19 +693,49 @@ func (ctx *Context) addEntry(key interface{}, value interface{}) {
 		}
 	}
 	if !foundPermission {
-		return
+		return errors.New("permission denied")
 	}
 	if ctx.TableInUse == -1 {
-		return
+		return errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return err
+	}
+	key, value, err := table.checkRow(key, value)
+	if err != nil {
+		return err
+	}
+	if table.hasExpired(key) {
+		// as far as anyone can tell it's gone already, the background expiry just hasn't deleted it yet
+		err := commitMutation(mutation{Op: walOpDeleteEntry, Database: dbs[ctx.DatabaseInUse].Name, Table: table.Name, Key: key})
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := table.lookup(key); ok {
+		return errors.New("key exists")
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
 	}
-	dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].addEntry(key, value)
+	return commitMutation(mutation{
+		Op:       walOpAddEntry,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+		Key:      key,
+		Value:    value,
+		User:     ctx.UserInUse,
+		Expires:  expires,
+	})
 }
 
-func (ctx *Context) tellEntryToFuckOff(key interface{}) {
+func (ctx *Context) tellEntryToFuckOff(key interface{}) error {
 	// make sure user has admin permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
@@ -427,19 +745,24 @@ func (ctx *Context) tellEntryToFuckOff(key interface{}) {
 		}
 	}
 	if !foundPermission {
-		return
+		return errors.New("permission denied")
 	}
 	if ctx.TableInUse == -1 {
-		return
-	}
-	dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].tellEntryToFuckOff(key)
+		return errors.New("no table in use")
+	}
+	return commitMutation(mutation{
+		Op:       walOpDeleteEntry,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+		Key:      key,
+	})
 }
 
-func (ctx *Context) changeEntry(key interface{}, value interface{}) {
+func (ctx *Context) changeEntry(key interface{}, value interface{}) error {
 	// make sure user has write permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
@@ -449,19 +772,38 @@ func (ctx *Context) changeEntry(key interface{}, value interface{}) {
 		}
 	}
 	if !foundPermission {
-		return
+		return errors.New("permission denied")
 	}
 	if ctx.TableInUse == -1 {
-		return
+		return errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return err
+	}
+	key, value, err := table.checkRow(key, value)
+	if err != nil {
+		return err
 	}
-	dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].changeEntry(key, value)
+	if table.getEntry(key) == nil {
+		return errors.New("key not found")
+	}
+	return commitMutation(mutation{
+		Op:       walOpChangeEntry,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+		Key:      key,
+		Value:    value,
+		User:     ctx.UserInUse,
+	})
 }
 
-func (ctx *Context) addTable(name string) {
+// addTable creates a table, declaration is its schema (see parseSchema), empty for a plain table
+func (ctx *Context) addTable(name string, declaration string) error {
 	// make sure user has admin permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
@@ -471,19 +813,33 @@ func (ctx *Context) addTable(name string) {
 		}
 	}
 	if !foundPermission {
-		return
+		return errors.New("permission denied")
 	}
 	if ctx.DatabaseInUse == -1 {
-		return
+		return errors.New("no database in use")
+	}
+	// the schema goes into the wal as its declaration
+	var schema interface{}
+	if declaration != "" {
+		columns, err := parseSchema(declaration)
+		if err != nil {
+			return err
+		}
+		schema = formatSchema(columns)
 	}
-	dbs[ctx.DatabaseInUse].addTable(name)
+	return commitMutation(mutation{
+		Op:       walOpCreateTable,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    name,
+		Value:    schema,
+	})
 }
 
-func (ctx *Context) tellTableToFuckOff(name string) {
+func (ctx *Context) tellTableToFuckOff(name string) error {
 	// make sure user has admin permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
@@ -493,12 +849,16 @@ func (ctx *Context) tellTableToFuckOff(name string) {
 		}
 	}
 	if !foundPermission {
-		return
+		return errors.New("permission denied")
 	}
 	if ctx.DatabaseInUse == -1 {
-		return
+		return errors.New("no database in use")
 	}
-	dbs[ctx.DatabaseInUse].tellTableToFuckOff(name)
+	return commitMutation(mutation{
+		Op:       walOpDeleteTable,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    name,
+	})
 }
 
 func (ctx *Context) getDBNames() []string {
@@ -567,9 +927,9 @@ func (ctx *Context) getEntryKeys() []interface{} {
 	if !foundPermission {
 		return nil
 	}
-	table := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
 	var keys []interface{}
-	for _, entry := range table.Data {
+	for _, entry := range table.entries() {
 		keys = append(keys, entry.Key)
 	}
 	return keys
@@ -591,110 +951,440 @@ func (ctx *Context) getEntryValues() []interface{} {
 	if !foundPermission {
 		return nil
 	}
-	table := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
 	var values []interface{}
-	for _, entry := range table.Data {
+	for _, entry := range table.entries() {
 		values = append(values, entry.Value)
 	}
 	return values
 }
 
-func (ctx *Context) addDatabase(name string) {
-	// make sure user has admin permissions
+func (ctx *Context) getEntryKeyRange(low interface{}, high interface{}, descending bool) ([]interface{}, error) {
+	// make sure user has read permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return nil, errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
-		if permission == PermAdmin {
+		if permission == PermRead {
 			foundPermission = true
 			break
 		}
 	}
 	if !foundPermission {
-		return
+		return nil, errors.New("permission denied")
 	}
-	db := Database{Name: name}
-	dbs = append(dbs, db)
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].keyRange(low, high, descending), nil
 }
 
-func (ctx *Context) tellDatabaseToFuckOff(name string) {
-	// make sure user has admin permissions
+func (ctx *Context) getEntryKeysWithPrefix(prefix string, descending bool) ([]interface{}, error) {
+	// make sure user has read permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return
+		return nil, errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
-		if permission == PermAdmin {
+		if permission == PermRead {
 			foundPermission = true
 			break
 		}
 	}
 	if !foundPermission {
-		return
+		return nil, errors.New("permission denied")
 	}
-	for i, db := range dbs {
-		if db.Name == name {
-			dbs = append(dbs[:i], dbs[i+1:]...)
-			return
-		}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
 	}
+	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].keysWithPrefix(prefix, descending), nil
 }
 
-func (ctx *Context) useDatabase(name string) error {
-	for i, db := range dbs {
-		if db.Name == name {
-			ctx.DatabaseInUse = i
-			ctx.TableInUse = -1
-			return nil
-		}
+func (ctx *Context) getEntryKeysWithValue(value interface{}) ([]interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
 	}
-	return errors.New("database not found")
-}
-
-func (ctx *Context) useTable(name string) error {
-	db := dbs[ctx.DatabaseInUse]
-	for i, table := range db.Tables {
-		if table.Name == name {
-			ctx.TableInUse = i
-			return nil
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
 		}
 	}
-	return errors.New("table not found")
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].keysWithValue(value), nil
 }
 
-func (ctx *Context) createUser(name string, password string) error {
-	// make sure user has admin permissions
+func (ctx *Context) getEntryKeysWithValuePrefix(prefix string) ([]interface{}, error) {
+	// make sure user has read permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
-		return errors.New("user not found")
+		return nil, errors.New("user not found")
 	}
 	foundPermission := false
 	for _, permission := range user.Value.(User).Permissions {
-		if permission == PermAdmin {
+		if permission == PermRead {
 			foundPermission = true
 			break
 		}
 	}
 	if !foundPermission {
-		return errors.New("permission denied")
-	}
-	// put user into system database
-	database := ctx.getDB("users")
-	if database == nil {
-		return errors.New("system database not found")
+		return nil, errors.New("permission denied")
 	}
-	table := database.getTable("users")
-	if table == nil {
-		return errors.New("users table not found")
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
 	}
-	table.addEntry(name, password)
-	return nil
+	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].keysWithValuePrefix(prefix), nil
 }
 
-func (ctx *Context) deleteUser(name string) error {
+func (ctx *Context) indexValues() error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	return commitMutation(mutation{
+		Op:       walOpIndexValues,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+	})
+}
+
+func (ctx *Context) forgetValueIndex() error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	return commitMutation(mutation{
+		Op:       walOpForgetIndex,
+		Database: dbs[ctx.DatabaseInUse].Name,
+		Table:    dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].Name,
+	})
+}
+
+// setEntry changes the entry if the key exists and creates it if it doesn't
+func (ctx *Context) setEntry(key interface{}, value interface{}) error {
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return err
+	}
+	// changeEntry and addEntry check permissions
+	if table.getEntry(key) != nil {
+		return ctx.changeEntry(key, value)
+	}
+	return ctx.addEntry(key, value)
+}
+
+// incrementEntry adds delta to a numeric entry and returns the new value, a missing key starts at 0
+// demands are handled one at a time, so nothing can change the entry between reading and writing it
+func (ctx *Context) incrementEntry(key interface{}, delta interface{}) (interface{}, error) {
+	// make sure user has read and write permissions, it reads the entry before anything is written
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundRead, foundWrite := false, false
+	for _, permission := range user.Value.(User).Permissions {
+		switch permission {
+		case PermRead:
+			foundRead = true
+		case PermWrite:
+			foundWrite = true
+		}
+	}
+	if !foundRead || !foundWrite {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	var current interface{} = int64(0)
+	entry := table.getEntry(key)
+	if entry != nil {
+		current = entry.Value
+	}
+	value, err := addNumbers(current, delta)
+	if err != nil {
+		return nil, fmt.Errorf("can't increment %s: %v", formatValue(key), err)
+	}
+	if entry != nil {
+		err = ctx.changeEntry(key, value)
+	} else {
+		err = ctx.addEntry(key, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// getRows returns the rows of the table in use whose column matches the filter (see columnMatches), in key order
+// each row is a map of column name to value, with only the given columns if there are any
+func (ctx *Context) getRows(columns []string, column string, op string, a interface{}, b interface{}) ([]interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	filter, err := table.columnIndex(column)
+	if err != nil {
+		return nil, err
+	}
+	var wanted []int
+	for _, name := range columns {
+		i, err := table.columnIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		wanted = append(wanted, i)
+	}
+	var matches []Entry
+	for _, entry := range table.entries() {
+		if columnMatches(table.columnValue(entry, filter), op, a, b) {
+			matches = append(matches, entry)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return compareValues(matches[i].Key, matches[j].Key) < 0 })
+	var rows []interface{}
+	for _, entry := range matches {
+		rows = append(rows, table.row(entry, wanted))
+	}
+	return rows, nil
+}
+
+// changeColumn sets one column of an existing row
+func (ctx *Context) changeColumn(key interface{}, column string, value interface{}) error {
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return err
+	}
+	i, err := table.columnIndex(column)
+	if err != nil {
+		return err
+	}
+	if i == 0 {
+		return errors.New("the key column can't be changed, create a new entry instead")
+	}
+	entry := ctx.getEntry(key)
+	if entry == nil {
+		return errors.New("entry not found")
+	}
+	existing, _ := entry.Value.(Record)
+	record := make(Record, len(table.schema)-1)
+	copy(record, existing)
+	record[i-1] = value
+	// changeEntry checks permissions and the new row
+	return ctx.changeEntry(key, record)
+}
+
+func (ctx *Context) addDatabase(name string) error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	// the name is the database's directory, it can't point anywhere else
+	if err := validateDatabaseName(name); err != nil {
+		return err
+	}
+	return commitMutation(mutation{Op: walOpCreateDatabase, Database: name})
+}
+
+func (ctx *Context) tellDatabaseToFuckOff(name string) error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	if findDatabase(name) == nil {
+		return errors.New("database not found")
+	}
+	return commitMutation(mutation{Op: walOpDeleteDatabase, Database: name})
+}
+
+func (ctx *Context) getDatabaseStatus(name string) (map[string]interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	db := findDatabase(name)
+	if db == nil {
+		return nil, errors.New("database not found")
+	}
+	return map[string]interface{}{
+		"last_save":       db.lastSave,
+		"pending_changes": int64(db.pendingChanges),
+		// what the last save wrote, before and after compression
+		"last_save_bytes":              db.lastSaveBytes,
+		"last_save_uncompressed_bytes": db.lastSaveUncompressedBytes,
+	}, nil
+}
+
+func (ctx *Context) rotateKey() error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	return rotateEncryptionKey()
+}
+
+func (ctx *Context) useDatabase(name string) error {
+	for i, db := range dbs {
+		if db.Name == name {
+			ctx.DatabaseInUse = i
+			ctx.TableInUse = -1
+			return nil
+		}
+	}
+	return errors.New("database not found")
+}
+
+func (ctx *Context) useTable(name string) error {
+	db := dbs[ctx.DatabaseInUse]
+	for i, table := range db.Tables {
+		if table.Name == name {
+			ctx.TableInUse = i
+			return nil
+		}
+	}
+	return errors.New("table not found")
+}
+
+func (ctx *Context) createUser(name string, password string) error {
+	// make sure user has admin permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermAdmin {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return errors.New("permission denied")
+	}
+	// put user into system database
+	database := ctx.getDB("users")
+	if database == nil {
+		return errors.New("system database not found")
+	}
+	table := database.getTable("users")
+	if table == nil {
+		return errors.New("users table not found")
+	}
+	return commitMutation(mutation{Op: walOpAddEntry, Database: "users", Table: "users", Key: name, Value: password, User: ctx.UserInUse})
+}
+
+func (ctx *Context) deleteUser(name string) error {
 	// make sure user has admin permissions
 	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
 	if user == nil {
@@ -719,8 +1409,7 @@ func (ctx *Context) deleteUser(name string) error {
 	if table == nil {
 		return errors.New("users table not found")
 	}
-	table.tellEntryToFuckOff(name)
-	return nil
+	return commitMutation(mutation{Op: walOpDeleteEntry, Database: "users", Table: "users", Key: name})
 }
 
 func (ctx *Context) login(name string, password string) error {
@@ -752,62 +1441,427 @@ func (ctx *Context) demandHandler(d Demand) (interface{}, error) {
 		if _, ok := d.Data.(string); !ok {
 			return nil, errors.New("demand data is not a string")
 		}
-		ctx.addDatabase(d.Data.(string))
-	case DemandCreateTable:
-		// make sure that the data of the demand is a string (the name of the table)
-		if _, ok := d.Data.(string); !ok {
-			return nil, errors.New("demand data is not a string")
+		if err := ctx.addDatabase(d.Data.(string)); err != nil {
+			return nil, err
+		}
+	case DemandCreateTable:
+		// make sure that the data of the demand is a string (the name of the table)
+		if _, ok := d.Data.(string); !ok {
+			return nil, errors.New("demand data is not a string")
+		}
+		if err := ctx.addTable(d.Data.(string), ""); err != nil {
+			return nil, err
+		}
+	case DemandCreateTableWithColumns:
+		// data should be an interface array, first being the name of the table, second being its columns (id:int, name:string, ...)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		name, ok := d.Data.([]interface{})[0].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, first element is not a string")
+		}
+		declaration, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a string")
+		}
+		if err := ctx.addTable(name, declaration); err != nil {
+			return nil, err
+		}
+	case DemandAddEntry:
+		// make sure that the data of the demand is a string (key,value)
+		if _, ok := d.Data.(string); !ok {
+			return nil, errors.New("demand data is not a string")
+		}
+		key, value, err := parseKeyValue(d.Data.(string))
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.addEntry(key, value); err != nil {
+			return nil, err
+		}
+	case DemandSetEntry:
+		// make sure that the data of the demand is an interface array (the key and value of the entry)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		// if entry already exists, change it, otherwise create it
+		if err := ctx.setEntry(d.Data.([]interface{})[0], d.Data.([]interface{})[1]); err != nil {
+			return nil, err
+		}
+	case DemandAddExpiringEntry:
+		// data should be an interface array, first being key,value like create, second being how long until it expires
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		keyValue, ok := d.Data.([]interface{})[0].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, first element is not a string")
+		}
+		ttl, ok := d.Data.([]interface{})[1].(time.Duration)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a duration")
+		}
+		key, value, err := parseKeyValue(keyValue)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.addExpiringEntry(key, value, ttl); err != nil {
+			return nil, err
+		}
+	case DemandExpireEntry:
+		// data should be an interface array, first being the key, second being how long until it expires (0 to never expire)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		ttl, ok := d.Data.([]interface{})[1].(time.Duration)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a duration")
+		}
+		if err := ctx.expireEntry(d.Data.([]interface{})[0], ttl); err != nil {
+			return nil, err
+		}
+	case DemandFindTTL:
+		// the data of the demand is the key of the entry
+		return ctx.getTTL(d.Data)
+	case DemandIncrementEntry:
+		// data should be an interface array, first being the key, second being the number to add (negative to decrement)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		return ctx.incrementEntry(d.Data.([]interface{})[0], d.Data.([]interface{})[1])
+	case DemandListPush:
+		// data should be an interface array: the key, the value to push and a bool (true to push to the front)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		front, ok := d.Data.([]interface{})[2].(bool)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, third element is not a bool")
+		}
+		op := walOp(walOpListPushBack)
+		if front {
+			op = walOpListPushFront
+		}
+		if _, err := ctx.changeCollection(op, d.Data.([]interface{})[0], d.Data.([]interface{})[1]); err != nil {
+			return nil, err
+		}
+	case DemandListPop:
+		// data should be an interface array: the key and a bool (true to pop from the front)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		front, ok := d.Data.([]interface{})[1].(bool)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a bool")
+		}
+		op := walOp(walOpListPopBack)
+		if front {
+			op = walOpListPopFront
+		}
+		return ctx.changeCollection(op, d.Data.([]interface{})[0], nil)
+	case DemandListIndex:
+		// data should be an interface array: the key and the index (an int)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		index, ok := d.Data.([]interface{})[1].(int64)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not an int")
+		}
+		list, err := ctx.getList(d.Data.([]interface{})[0])
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := listIndex(index, len(list)); ok {
+			return list[i], nil
+		}
+		return nil, nil
+	case DemandListRange:
+		// data should be an interface array: the key, the first index and the last index (ints)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		start, ok := d.Data.([]interface{})[1].(int64)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, second element is not an int")
+		}
+		stop, ok := d.Data.([]interface{})[2].(int64)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, third element is not an int")
+		}
+		list, err := ctx.getList(d.Data.([]interface{})[0])
+		if err != nil {
+			return nil, err
+		}
+		return listRange(list, start, stop), nil
+	case DemandListLength:
+		// the data of the demand is the key of the list
+		list, err := ctx.getList(d.Data)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(list)), nil
+	case DemandSetAdd, DemandSetRemove:
+		// data should be an interface array: the key and the member
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		op := walOp(walOpSetAdd)
+		if d.TypeOfDemand == DemandSetRemove {
+			op = walOpSetRemove
+		}
+		if _, err := ctx.changeCollection(op, d.Data.([]interface{})[0], d.Data.([]interface{})[1]); err != nil {
+			return nil, err
+		}
+	case DemandSetHas:
+		// data should be an interface array: the key and the member
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		set, err := ctx.getSet(d.Data.([]interface{})[0])
+		if err != nil {
+			return nil, err
+		}
+		if validateKey(d.Data.([]interface{})[1]) != nil {
+			return false, nil
+		}
+		return set[d.Data.([]interface{})[1]], nil
+	case DemandSetMembers:
+		// the data of the demand is the key of the set
+		set, err := ctx.getSet(d.Data)
+		if err != nil {
+			return nil, err
+		}
+		return set.members(), nil
+	case DemandSetSize:
+		// the data of the demand is the key of the set
+		set, err := ctx.getSet(d.Data)
+		if err != nil {
+			return nil, err
+		}
+		return int64(len(set)), nil
+	case DemandSetCombine:
+		// data should be an interface array: the key of each set and a bool (true for the union, false for the intersection)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		union, ok := d.Data.([]interface{})[2].(bool)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, third element is not a bool")
+		}
+		a, err := ctx.getSet(d.Data.([]interface{})[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := ctx.getSet(d.Data.([]interface{})[1])
+		if err != nil {
+			return nil, err
+		}
+		return combineSets(a, b, union), nil
+	case DemandFindPath:
+		// data should be an interface array, the key of the document and the path to read
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		path, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a string")
+		}
+		return ctx.getPath(d.Data.([]interface{})[0], path)
+	case DemandSetPath:
+		// data should be an interface array, the key of the document, the path and its new value
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		path, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, second element is not a string")
+		}
+		if err := ctx.setPath(d.Data.([]interface{})[0], path, d.Data.([]interface{})[2]); err != nil {
+			return nil, err
+		}
+	case DemandFindPathValue:
+		// data should be an interface array: the path, the filter (is, between or starts with) and its one or two values
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 4 {
+			return nil, errors.New("demand data is not an interface array of length 4")
+		}
+		path, ok := d.Data.([]interface{})[0].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 4, first element is not a string")
 		}
-		ctx.addTable(d.Data.(string))
-	case DemandAddEntry:
-		// make sure that the data of the demand is a string (key,value)
-		if _, ok := d.Data.(string); !ok {
-			return nil, errors.New("demand data is not a string")
+		op, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 4, second element is not a string")
 		}
-		key := strings.Split(d.Data.(string), ",")[0]
-		value := strings.Split(d.Data.(string), ",")[1]
-		ctx.addEntry(key, value)
-	case DemandSetEntry:
-		// make sure that the data of the demand is a string array (the key and value of the entry)
+		return ctx.getEntryKeysWithPath(path, op, d.Data.([]interface{})[2], d.Data.([]interface{})[3])
+	case DemandFindVersion:
+		// the data of the demand is the key of the entry
+		version, err := ctx.getVersion(d.Data)
+		if err != nil {
+			return nil, err
+		}
+		return int64(version), nil
+	case DemandSetEntryIf:
+		// data should be an interface array: the key, the new value, the condition (version or value) and what it should be
 		if _, ok := d.Data.([]interface{}); !ok {
-			return nil, errors.New("demand data is not a string array")
+			return nil, errors.New("demand data is not an interface array")
 		}
-		if len(d.Data.([]interface{})) != 2 {
-			return nil, errors.New("demand data is not a string array of length 2")
+		if len(d.Data.([]interface{})) != 4 {
+			return nil, errors.New("demand data is not an interface array of length 4")
 		}
-		// if entry already exists, change it
-		if entry := ctx.getEntry(d.Data.([]interface{})[0]); entry != nil {
-			ctx.changeEntry(d.Data.([]interface{})[0], d.Data.([]interface{})[1])
-		} else {
-			ctx.addEntry(d.Data.([]interface{})[0], d.Data.([]interface{})[1])
+		condition, ok := d.Data.([]interface{})[2].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 4, third element is not a string")
 		}
-	case DemandDeleteEntry:
-		// make sure that the data of the demand is a string (the key of the entry)
+		if err := ctx.setEntryIf(d.Data.([]interface{})[0], d.Data.([]interface{})[1], condition, d.Data.([]interface{})[3]); err != nil {
+			return nil, err
+		}
+	case DemandFindEntryWithMetadata:
+		// the data of the demand is the key of the entry
+		return ctx.getEntryWithMetadata(d.Data)
+	case DemandFindMetadata:
+		// data should be an interface array: the field (created, updated or writer), the filter (after, before or is) and what to compare with
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		field, ok := d.Data.([]interface{})[0].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, first element is not a string")
+		}
+		op, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, second element is not a string")
+		}
+		return ctx.getEntryKeysWithMetadata(field, op, d.Data.([]interface{})[2])
+	case DemandReplaceEntry:
+		// make sure that the data of the demand is a string (key,value), the key has to exist
 		if _, ok := d.Data.(string); !ok {
 			return nil, errors.New("demand data is not a string")
 		}
-		ctx.tellEntryToFuckOff(d.Data.(string))
+		key, value, err := parseKeyValue(d.Data.(string))
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.changeEntry(key, value); err != nil {
+			return nil, err
+		}
+	case DemandDeleteEntry:
+		// the data of the demand is the key of the entry
+		if err := ctx.tellEntryToFuckOff(d.Data); err != nil {
+			return nil, err
+		}
 	case DemandDeleteTable:
 		// make sure that the data of the demand is a string (the name of the table)
 		if _, ok := d.Data.(string); !ok {
 			return nil, errors.New("demand data is not a string")
 		}
-		ctx.tellTableToFuckOff(d.Data.(string))
+		if err := ctx.tellTableToFuckOff(d.Data.(string)); err != nil {
+			return nil, err
+		}
 	case DemandDeleteDatabase:
 		// make sure that the data of the demand is a string (the name of the database)
 		if _, ok := d.Data.(string); !ok {
 			return nil, errors.New("demand data is not a string")
 		}
-		ctx.tellDatabaseToFuckOff(d.Data.(string))
-	case DemandFindEntry:
-		// make sure that the data of the demand is a string (the key of the entry)
-		if _, ok := d.Data.(string); !ok {
-			return nil, errors.New("demand data is not a string")
+		if err := ctx.tellDatabaseToFuckOff(d.Data.(string)); err != nil {
+			return nil, err
 		}
-		if entry := ctx.getEntry(d.Data.(string)); entry != nil {
+	case DemandFindEntry:
+		// the data of the demand is the key of the entry
+		if entry := ctx.getEntry(d.Data); entry != nil {
+			// rows in a table with a schema come back by column
+			if table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]; table.schema != nil {
+				return table.row(*entry, nil), nil
+			}
 			return entry.Value, nil
 		}
 		return nil, nil
+	case DemandFindRows:
+		// data should be an interface array: the columns to return (empty for all of them), the column to filter on,
+		// the filter (is, between or starts with) and its one or two values
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 5 {
+			return nil, errors.New("demand data is not an interface array of length 5")
+		}
+		columns, ok := d.Data.([]interface{})[0].([]string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 5, first element is not a string array")
+		}
+		column, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 5, second element is not a string")
+		}
+		op, ok := d.Data.([]interface{})[2].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 5, third element is not a string")
+		}
+		return ctx.getRows(columns, column, op, d.Data.([]interface{})[3], d.Data.([]interface{})[4])
+	case DemandSetColumn:
+		// data should be an interface array, the key of the entry, the column and its new value
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		column, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, second element is not a string")
+		}
+		if err := ctx.changeColumn(d.Data.([]interface{})[0], column, d.Data.([]interface{})[2]); err != nil {
+			return nil, err
+		}
 	case DemandFindEntries:
 		// data should be an interface array, first being a bool (true if searching by key, false if searching by value), second being a regex
 		if _, ok := d.Data.([]interface{}); !ok {
@@ -830,11 +1884,90 @@ func (ctx *Context) demandHandler(d Demand) (interface{}, error) {
 		}
 		var matches []interface{}
 		for _, key := range keys {
-			if regexp.MustCompile(d.Data.([]interface{})[1].(string)).MatchString(key.(string)) {
+			if regexp.MustCompile(d.Data.([]interface{})[1].(string)).MatchString(formatValue(key)) {
 				matches = append(matches, key)
 			}
 		}
 		return matches, nil
+	case DemandFindKeyRange:
+		// data should be an interface array, the lowest key, the highest key and a bool (true for descending order)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 3 {
+			return nil, errors.New("demand data is not an interface array of length 3")
+		}
+		if _, ok := d.Data.([]interface{})[2].(bool); !ok {
+			return nil, errors.New("demand data is not an interface array of length 3, third element is not a bool")
+		}
+		return ctx.getEntryKeyRange(d.Data.([]interface{})[0], d.Data.([]interface{})[1], d.Data.([]interface{})[2].(bool))
+	case DemandFindKeyPrefix:
+		// data should be an interface array, the prefix and a bool (true for descending order)
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		if _, ok := d.Data.([]interface{})[0].(string); !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, first element is not a string")
+		}
+		if _, ok := d.Data.([]interface{})[1].(bool); !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a bool")
+		}
+		return ctx.getEntryKeysWithPrefix(d.Data.([]interface{})[0].(string), d.Data.([]interface{})[1].(bool))
+	case DemandFindValue:
+		// the data of the demand is the value to look for
+		return ctx.getEntryKeysWithValue(d.Data)
+	case DemandFindValuePrefix:
+		// data should be a string (the prefix)
+		if _, ok := d.Data.(string); !ok {
+			return nil, errors.New("demand data is not a string")
+		}
+		return ctx.getEntryKeysWithValuePrefix(d.Data.(string))
+	case DemandIndexValues:
+		// no data, the table in use gets indexed
+		if err := ctx.indexValues(); err != nil {
+			return nil, err
+		}
+	case DemandForgetIndex:
+		// no data, the table in use forgets its index
+		if err := ctx.forgetValueIndex(); err != nil {
+			return nil, err
+		}
+	case DemandDatabaseStatus:
+		// data should be a string (the name of the database), empty for the database in use
+		if _, ok := d.Data.(string); !ok {
+			return nil, errors.New("demand data is not a string")
+		}
+		name := d.Data.(string)
+		if name == "" {
+			name = dbs[ctx.DatabaseInUse].Name
+		}
+		return ctx.getDatabaseStatus(name)
+	case DemandBackup:
+		// data should be an interface array, first being the name of the database (empty for all of them), second being the directory to back up to
+		if _, ok := d.Data.([]interface{}); !ok {
+			return nil, errors.New("demand data is not an interface array")
+		}
+		if len(d.Data.([]interface{})) != 2 {
+			return nil, errors.New("demand data is not an interface array of length 2")
+		}
+		name, ok := d.Data.([]interface{})[0].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, first element is not a string")
+		}
+		dir, ok := d.Data.([]interface{})[1].(string)
+		if !ok {
+			return nil, errors.New("demand data is not an interface array of length 2, second element is not a string")
+		}
+		if err := ctx.backup(name, dir); err != nil {
+			return nil, err
+		}
+	case DemandRotateKey:
+		if err := ctx.rotateKey(); err != nil {
+			return nil, err
+		}
 	case DemandSetEntries:
 		// set entries should be an interface array, first being a bool (true if searching by key, false if searching by value), second being a regex, third being the value to set
 		if _, ok := d.Data.([]interface{}); !ok {
@@ -849,9 +1982,6 @@ func (ctx *Context) demandHandler(d Demand) (interface{}, error) {
 		if _, ok := d.Data.([]interface{})[1].(string); !ok {
 			return nil, errors.New("demand data is not an interface array of length 3, second element is not a string")
 		}
-		if _, ok := d.Data.([]interface{})[2].(string); !ok {
-			return nil, errors.New("demand data is not an interface array of length 3, third element is not a string")
-		}
 		var keys []interface{}
 		if d.Data.([]interface{})[0].(bool) {
 			keys = ctx.getEntryKeys()
@@ -859,8 +1989,10 @@ func (ctx *Context) demandHandler(d Demand) (interface{}, error) {
 			keys = ctx.getEntryValues()
 		}
 		for _, key := range keys {
-			if regexp.MustCompile(d.Data.([]interface{})[1].(string)).MatchString(key.(string)) {
-				ctx.changeEntry(key.(string), d.Data.([]interface{})[2].(string))
+			if regexp.MustCompile(d.Data.([]interface{})[1].(string)).MatchString(formatValue(key)) {
+				if err := ctx.changeEntry(key, d.Data.([]interface{})[2]); err != nil {
+					return nil, err
+				}
 			}
 		}
 	case DemandDeleteEntries:
@@ -884,8 +2016,10 @@ func (ctx *Context) demandHandler(d Demand) (interface{}, error) {
 			keys = ctx.getEntryValues()
 		}
 		for _, key := range keys {
-			if regexp.MustCompile(d.Data.([]interface{})[1].(string)).MatchString(key.(string)) {
-				ctx.tellEntryToFuckOff(key.(string))
+			if regexp.MustCompile(d.Data.([]interface{})[1].(string)).MatchString(formatValue(key)) {
+				if err := ctx.tellEntryToFuckOff(key); err != nil {
+					return nil, err
+				}
 			}
 		}
 	case DemandUseDatabase:
@@ -957,29 +2091,51 @@ func (ctx *Context) demandHandler(d Demand) (interface{}, error) {
 	return nil, nil
 }
 
-func (ctx *Context) parseCommand(cmd string) (*Demand, error) {
-	var d *Demand
+func (ctx *Context) parseCommand(cmd string) (d *Demand, err error) {
+	// a command that stops early would index past its last word somewhere below, that's the client's mistake and not a crash
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(runtime.Error); ok && strings.Contains(e.Error(), "out of range") {
+				d, err = nil, errors.New("command is incomplete")
+				return
+			}
+			panic(r)
+		}
+	}()
+	d = &Demand{}
+	// the command may be padded with null bytes from the connection buffer
+	cmd = strings.TrimSpace(strings.TrimRight(cmd, "\x00"))
 	if cmd == "" {
 		return nil, errors.New("command is empty")
 	}
 	insideString := false
 	var commandArray []string
 	// go through command and split by spaces unless it's a string
-	// if it's a string, split by "
-	for i, c := range cmd {
-		if c == '"' {
-			if i == 0 || cmd[i-1] != '\\' {
-				insideString = !insideString
+	// strings keep their quotes so literals can tell "42" from 42
+	start := 0
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == '\\' && insideString {
+			i++
+			continue
+		}
+		if cmd[i] == '"' {
+			insideString = !insideString
+		}
+		if cmd[i] == ' ' && !insideString {
+			if i > start {
+				commandArray = append(commandArray, cmd[start:i])
 			}
+			start = i + 1
 		}
-		if c == ' ' && !insideString {
-			commandArray = append(commandArray, cmd[:i])
-			cmd = cmd[i+1:]
-			i = 0
-		}
+	}
+	if start < len(cmd) {
+		commandArray = append(commandArray, cmd[start:])
 	}
 	switch strings.ToLower(commandArray[0]) {
 	case "use":
+		if len(commandArray) < 3 {
+			return nil, errors.New("expected use database <name> or use table <name>")
+		}
 		switch strings.ToLower(commandArray[1]) {
 		case "database":
 			d.TypeOfDemand = DemandUseDatabase
@@ -994,35 +2150,211 @@ func (ctx *Context) parseCommand(cmd string) (*Demand, error) {
 		d.TypeOfDemand = DemandLogin
 		d.Data = commandArray[1:]
 	case "tell":
+		if len(commandArray) < 4 {
+			return nil, errors.New("expected tell entry|list|set|table|database to <command>")
+		}
 		switch strings.ToLower(commandArray[1]) {
 		case "entry":
 			switch strings.ToLower(commandArray[2]) {
 			case "to":
 				switch strings.ToLower(commandArray[3]) {
 				case "present":
+					if len(commandArray) < 5 {
+						return nil, errors.New("expected tell entry to present <key>")
+					}
 					// if next word is "where", then it will be finding entries
+					// a list of columns before "where column" picks what comes back from a table with a schema
 					// otherwise, the next word will be the key
-					if strings.ToLower(commandArray[4]) == "where" {
+					if where := wordIndex(commandArray, 4, "where"); where != -1 && len(commandArray) > where+2 && strings.ToLower(commandArray[where+1]) == "column" {
+						// where column <name> is <value>, between <low> and <high>, or starts with <prefix>
+						var columns []string
+						if where > 4 {
+							for _, name := range strings.Split(strings.Join(commandArray[4:where], " "), ",") {
+								if name = strings.TrimSpace(name); name != "" {
+									columns = append(columns, name)
+								}
+							}
+						}
+						column := commandArray[where+2]
+						op, a, b, err := parseFilter(commandArray[where+3:])
+						if err != nil {
+							return nil, fmt.Errorf("where column <name>: %v", err)
+						}
+						d.TypeOfDemand = DemandFindRows
+						d.Data = []interface{}{columns, column, op, a, b}
+					} else if strings.ToLower(commandArray[4]) == "where" {
+						if len(commandArray) < 7 {
+							return nil, errors.New("expected tell entry to present where key|value|path|created|updated|writer ...")
+						}
 						// if next word is "key", then find entries by key
 						// otherwise, find entries by value
-						if strings.ToLower(commandArray[5]) == "key" {
+						// where key between <low> and <high> and where key starts with <prefix> use the ordered index,
+						// both can end with ascending or descending
+						if strings.ToLower(commandArray[5]) == "key" && len(commandArray) > 9 && strings.ToLower(commandArray[6]) == "between" && strings.ToLower(commandArray[8]) == "and" {
+							low, err := parseLiteral(commandArray[7])
+							if err != nil {
+								return nil, err
+							}
+							high, err := parseLiteral(commandArray[9])
+							if err != nil {
+								return nil, err
+							}
+							descending, err := parseOrder(commandArray[10:])
+							if err != nil {
+								return nil, err
+							}
+							d.TypeOfDemand = DemandFindKeyRange
+							d.Data = []interface{}{low, high, descending}
+						} else if strings.ToLower(commandArray[5]) == "key" && len(commandArray) > 8 && strings.ToLower(commandArray[6]) == "starts" && strings.ToLower(commandArray[7]) == "with" {
+							descending, err := parseOrder(commandArray[9:])
+							if err != nil {
+								return nil, err
+							}
+							d.TypeOfDemand = DemandFindKeyPrefix
+							d.Data = []interface{}{parseStringLiteral(commandArray[8]), descending}
+						} else if strings.ToLower(commandArray[5]) == "key" {
 							d.TypeOfDemand = DemandFindEntries
-							d.Data = []interface{}{true, commandArray[6]}
+							d.Data = []interface{}{true, parseStringLiteral(commandArray[6])}
+						} else if strings.ToLower(commandArray[5]) == "value" && len(commandArray) > 7 && strings.ToLower(commandArray[6]) == "is" {
+							// where value is <value> and where value starts with <prefix> use the value index if there is one
+							value, err := parseLiteral(commandArray[7])
+							if err != nil {
+								return nil, err
+							}
+							d.TypeOfDemand = DemandFindValue
+							d.Data = value
+						} else if strings.ToLower(commandArray[5]) == "value" && len(commandArray) > 8 && strings.ToLower(commandArray[6]) == "starts" && strings.ToLower(commandArray[7]) == "with" {
+							d.TypeOfDemand = DemandFindValuePrefix
+							d.Data = parseStringLiteral(commandArray[8])
 						} else if strings.ToLower(commandArray[5]) == "value" {
 							d.TypeOfDemand = DemandFindEntries
-							d.Data = []interface{}{false, commandArray[6]}
+							d.Data = []interface{}{false, parseStringLiteral(commandArray[6])}
+						} else if strings.ToLower(commandArray[5]) == "path" && len(commandArray) > 7 {
+							// where path <path> is <value>, between <low> and <high>, or starts with <prefix> looks inside documents
+							op, a, b, err := parseFilter(commandArray[7:])
+							if err != nil {
+								return nil, fmt.Errorf("where path <path>: %v", err)
+							}
+							d.TypeOfDemand = DemandFindPathValue
+							d.Data = []interface{}{commandArray[6], op, a, b}
+						} else if field := strings.ToLower(commandArray[5]); (field == "created" || field == "updated") && len(commandArray) == 8 {
+							// where created|updated after|before <time>
+							if op := strings.ToLower(commandArray[6]); op != "after" && op != "before" {
+								return nil, fmt.Errorf("expected where %s after|before <time>", field)
+							}
+							at, err := parseTime(commandArray[7])
+							if err != nil {
+								return nil, err
+							}
+							d.TypeOfDemand = DemandFindMetadata
+							d.Data = []interface{}{field, strings.ToLower(commandArray[6]), at}
+						} else if field == "writer" && len(commandArray) == 8 && strings.ToLower(commandArray[6]) == "is" {
+							// where writer is <user>
+							d.TypeOfDemand = DemandFindMetadata
+							d.Data = []interface{}{field, "is", parseStringLiteral(commandArray[7])}
 						} else {
 							return nil, errors.New("unknown tell entry to present command")
 						}
+					} else if len(commandArray) > 5 && strings.ToLower(commandArray[4]) == "ttl" {
+						// tell entry to present ttl <key>
+						key, err := parseLiteral(commandArray[5])
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandFindTTL
+						d.Data = key
+					} else if len(commandArray) > 5 && strings.ToLower(commandArray[4]) == "version" {
+						// tell entry to present version <key>
+						key, err := parseLiteral(commandArray[5])
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandFindVersion
+						d.Data = key
+					} else if len(commandArray) == 7 && strings.ToLower(commandArray[5]) == "at" {
+						// tell entry to present <key> at <path> reads part of a document
+						key, err := parseLiteral(commandArray[4])
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandFindPath
+						d.Data = []interface{}{key, commandArray[6]}
+					} else if len(commandArray) == 7 && strings.ToLower(commandArray[5]) == "with" && strings.ToLower(commandArray[6]) == "metadata" {
+						// tell entry to present <key> with metadata
+						key, err := parseLiteral(commandArray[4])
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandFindEntryWithMetadata
+						d.Data = key
 					} else {
 						d.TypeOfDemand = DemandFindEntry
 						// last word will be the key
-						d.Data = commandArray[4]
+						key, err := parseLiteral(commandArray[4])
+						if err != nil {
+							return nil, err
+						}
+						d.Data = key
 					}
 				case "create":
-					// first word is key,value
-					d.TypeOfDemand = DemandAddEntry
-					d.Data = commandArray[4]
+					// the rest is key,value (or key,column,column,... for a table with a schema), the key can't exist yet
+					// it can end with expire in <duration>
+					words := commandArray[4:]
+					if len(words) > 3 && strings.ToLower(words[len(words)-3]) == "expire" && strings.ToLower(words[len(words)-2]) == "in" {
+						ttl, err := parseTTL(words[len(words)-1])
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandAddExpiringEntry
+						d.Data = []interface{}{strings.Join(words[:len(words)-3], " "), ttl}
+					} else {
+						d.TypeOfDemand = DemandAddEntry
+						d.Data = strings.Join(words, " ")
+					}
+				case "expire":
+					// tell entry to expire <key> in <duration>, or never
+					var ttl time.Duration
+					if len(commandArray) == 7 && strings.ToLower(commandArray[5]) == "in" {
+						var err error
+						if ttl, err = parseTTL(commandArray[6]); err != nil {
+							return nil, err
+						}
+					} else if len(commandArray) != 6 || strings.ToLower(commandArray[5]) != "never" {
+						return nil, errors.New("expected tell entry to expire <key> in <duration> or tell entry to expire <key> never")
+					}
+					key, err := parseLiteral(commandArray[4])
+					if err != nil {
+						return nil, err
+					}
+					d.TypeOfDemand = DemandExpireEntry
+					d.Data = []interface{}{key, ttl}
+				case "increment", "decrement":
+					// tell entry to increment <key> [by <number>], decrement is the same with the number negated
+					var delta interface{} = int64(1)
+					if len(commandArray) == 7 && strings.ToLower(commandArray[5]) == "by" {
+						var err error
+						if delta, err = parseLiteral(commandArray[6]); err != nil {
+							return nil, err
+						}
+					} else if len(commandArray) != 5 {
+						return nil, fmt.Errorf("expected tell entry to %s <key> [by <number>]", strings.ToLower(commandArray[3]))
+					}
+					if strings.ToLower(commandArray[3]) == "decrement" {
+						var err error
+						if delta, err = negateNumber(delta); err != nil {
+							return nil, err
+						}
+					}
+					key, err := parseLiteral(commandArray[4])
+					if err != nil {
+						return nil, err
+					}
+					d.TypeOfDemand = DemandIncrementEntry
+					d.Data = []interface{}{key, delta}
+				case "replace":
+					// same as create, but the key has to exist
+					d.TypeOfDemand = DemandReplaceEntry
+					d.Data = strings.Join(commandArray[4:], " ")
 				case "fuck":
 					// if next word is off, tell entry to fuck off
 					if strings.ToLower(commandArray[4]) == "off" {
@@ -1033,51 +2365,259 @@ func (ctx *Context) parseCommand(cmd string) (*Demand, error) {
 							// otherwise, find entries by value
 							if strings.ToLower(commandArray[6]) == "key" {
 								d.TypeOfDemand = DemandDeleteEntries
-								d.Data = []interface{}{true, commandArray[7]}
+								d.Data = []interface{}{true, parseStringLiteral(commandArray[7])}
 							} else if strings.ToLower(commandArray[6]) == "value" {
 								d.TypeOfDemand = DemandDeleteEntries
-								d.Data = []interface{}{false, commandArray[7]}
+								d.Data = []interface{}{false, parseStringLiteral(commandArray[7])}
 							} else {
 								return nil, errors.New("unknown tell entry to fuck off command")
 							}
 						} else {
 							d.TypeOfDemand = DemandDeleteEntry
 							// last word will be the key
-							d.Data = commandArray[5]
+							key, err := parseLiteral(commandArray[5])
+							if err != nil {
+								return nil, err
+							}
+							d.Data = key
 						}
 					} else {
 						return nil, errors.New("unknown tell entry to fuck command")
 					}
 				case "become":
-					// if next word is "where", then it will be finding entries
+					// if next word is "where", then it will be setting entries
 					// otherwise, the next word will be the key
 					if strings.ToLower(commandArray[4]) == "where" {
+						// where key/value <regex> <new value>
+						if len(commandArray) < 8 {
+							return nil, errors.New("tell entry to become where needs a regex and a value")
+						}
+						value, err := parseLiteral(commandArray[7])
+						if err != nil {
+							return nil, err
+						}
 						// if next word is "key", then find entries by key
 						// otherwise, find entries by value
 						if strings.ToLower(commandArray[5]) == "key" {
 							d.TypeOfDemand = DemandSetEntries
-							d.Data = []interface{}{true, commandArray[6]}
+							d.Data = []interface{}{true, parseStringLiteral(commandArray[6]), value}
 						} else if strings.ToLower(commandArray[5]) == "value" {
 							d.TypeOfDemand = DemandSetEntries
-							d.Data = []interface{}{false, commandArray[6]}
+							d.Data = []interface{}{false, parseStringLiteral(commandArray[6]), value}
 						} else {
 							return nil, errors.New("unknown tell entry to become command")
 						}
+					} else if len(commandArray) > 7 && strings.ToLower(commandArray[5]) == "with" {
+						// tell entry to become <key> with <column> <value> changes one column
+						key, err := parseLiteral(commandArray[4])
+						if err != nil {
+							return nil, err
+						}
+						value, err := parseLiteral(commandArray[7])
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandSetColumn
+						d.Data = []interface{}{key, commandArray[6], value}
+					} else if len(commandArray) > 6 && strings.ToLower(commandArray[5]) == "at" {
+						// tell entry to become <key> at <path>,<value> changes part of a document
+						key, err := parseLiteral(commandArray[4])
+						if err != nil {
+							return nil, err
+						}
+						parts := splitLiterals(strings.Join(commandArray[6:], " "))
+						if len(parts) != 2 {
+							return nil, errors.New("expected tell entry to become <key> at <path>,<value>")
+						}
+						value, err := parseLiteral(strings.TrimSpace(parts[1]))
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandSetPath
+						d.Data = []interface{}{key, strings.TrimSpace(parts[0]), value}
+					} else if words := commandArray[4:]; len(words) > 3 && strings.ToLower(words[len(words)-3]) == "if" {
+						// key,value if version <n> or if value <old value> only changes the entry if it still is what the client saw
+						condition := strings.ToLower(words[len(words)-2])
+						if condition != "version" && condition != "value" {
+							return nil, errors.New("expected tell entry to become <key>,<value> if version <n> or if value <value>")
+						}
+						expected, err := parseLiteral(words[len(words)-1])
+						if err != nil {
+							return nil, err
+						}
+						key, value, err := parseKeyValue(strings.Join(words[:len(words)-3], " "))
+						if err != nil {
+							return nil, err
+						}
+						d.TypeOfDemand = DemandSetEntryIf
+						d.Data = []interface{}{key, value, condition, expected}
 					} else {
 						d.TypeOfDemand = DemandSetEntry
-						// last word will be the key and value separated by a comma
-						d.Data = strings.Split(commandArray[4], ",")
+						// the rest is the key and value separated by a comma
+						key, value, err := parseKeyValue(strings.Join(commandArray[4:], " "))
+						if err != nil {
+							return nil, err
+						}
+						d.Data = []interface{}{key, value}
+					}
+				}
+			}
+		case "list":
+			if len(commandArray) < 4 || strings.ToLower(commandArray[2]) != "to" {
+				return nil, errors.New("unknown tell list command")
+			}
+			words := commandArray[4:]
+			switch strings.ToLower(commandArray[3]) {
+			case "push":
+				// tell list to push front|back <key> <value>
+				if len(words) != 3 || (strings.ToLower(words[0]) != "front" && strings.ToLower(words[0]) != "back") {
+					return nil, errors.New("expected tell list to push front|back <key> <value>")
+				}
+				key, err := parseLiteral(words[1])
+				if err != nil {
+					return nil, err
+				}
+				value, err := parseLiteral(words[2])
+				if err != nil {
+					return nil, err
+				}
+				d.TypeOfDemand = DemandListPush
+				d.Data = []interface{}{key, value, strings.ToLower(words[0]) == "front"}
+			case "pop":
+				// tell list to pop front|back <key>
+				if len(words) != 2 || (strings.ToLower(words[0]) != "front" && strings.ToLower(words[0]) != "back") {
+					return nil, errors.New("expected tell list to pop front|back <key>")
+				}
+				key, err := parseLiteral(words[1])
+				if err != nil {
+					return nil, err
+				}
+				d.TypeOfDemand = DemandListPop
+				d.Data = []interface{}{key, strings.ToLower(words[0]) == "front"}
+			case "present":
+				// tell list to present <key> at <index>, <key> from <start> to <stop>, or length <key>
+				if len(words) == 2 && strings.ToLower(words[0]) == "length" {
+					key, err := parseLiteral(words[1])
+					if err != nil {
+						return nil, err
+					}
+					d.TypeOfDemand = DemandListLength
+					d.Data = key
+					break
+				}
+				var literals []interface{}
+				for i, word := range words {
+					if i%2 == 1 {
+						continue
+					}
+					literal, err := parseLiteral(word)
+					if err != nil {
+						return nil, err
+					}
+					literals = append(literals, literal)
+				}
+				if len(words) == 3 && strings.ToLower(words[1]) == "at" {
+					d.TypeOfDemand = DemandListIndex
+				} else if len(words) == 5 && strings.ToLower(words[1]) == "from" && strings.ToLower(words[3]) == "to" {
+					d.TypeOfDemand = DemandListRange
+				} else {
+					return nil, errors.New("expected tell list to present <key> at <index>, <key> from <start> to <stop> or length <key>")
+				}
+				d.Data = literals
+			default:
+				return nil, errors.New("unknown tell list command")
+			}
+		case "set":
+			if len(commandArray) < 4 || strings.ToLower(commandArray[2]) != "to" {
+				return nil, errors.New("unknown tell set command")
+			}
+			words := commandArray[4:]
+			switch strings.ToLower(commandArray[3]) {
+			case "add", "remove":
+				// tell set to add|remove <key> <member>
+				if len(words) != 2 {
+					return nil, fmt.Errorf("expected tell set to %s <key> <member>", strings.ToLower(commandArray[3]))
+				}
+				key, err := parseLiteral(words[0])
+				if err != nil {
+					return nil, err
+				}
+				member, err := parseLiteral(words[1])
+				if err != nil {
+					return nil, err
+				}
+				d.TypeOfDemand = DemandSetAdd
+				if strings.ToLower(commandArray[3]) == "remove" {
+					d.TypeOfDemand = DemandSetRemove
+				}
+				d.Data = []interface{}{key, member}
+			case "present":
+				// tell set to present <key>, <key> has <member>, size <key>, or <key> union|intersection <other key>
+				if len(words) == 2 && strings.ToLower(words[0]) == "size" {
+					key, err := parseLiteral(words[1])
+					if err != nil {
+						return nil, err
 					}
+					d.TypeOfDemand = DemandSetSize
+					d.Data = key
+					break
+				}
+				if len(words) != 1 && len(words) != 3 {
+					return nil, errors.New("expected tell set to present <key>, <key> has <member>, size <key> or <key> union|intersection <other key>")
+				}
+				key, err := parseLiteral(words[0])
+				if err != nil {
+					return nil, err
+				}
+				if len(words) == 1 {
+					d.TypeOfDemand = DemandSetMembers
+					d.Data = key
+					break
+				}
+				other, err := parseLiteral(words[2])
+				if err != nil {
+					return nil, err
+				}
+				switch strings.ToLower(words[1]) {
+				case "has":
+					d.TypeOfDemand = DemandSetHas
+					d.Data = []interface{}{key, other}
+				case "union", "intersection":
+					d.TypeOfDemand = DemandSetCombine
+					d.Data = []interface{}{key, other, strings.ToLower(words[1]) == "union"}
+				default:
+					return nil, errors.New("expected has, union or intersection")
 				}
+			default:
+				return nil, errors.New("unknown tell set command")
 			}
 		case "table":
 			switch strings.ToLower(commandArray[2]) {
 			case "to":
 				switch strings.ToLower(commandArray[3]) {
 				case "create":
-					// first word is name of table
-					d.TypeOfDemand = DemandCreateTable
-					d.Data = commandArray[4]
+					// first word is name of table, tell table to create <name> with columns id:int, name:string, ... gives it a schema
+					if len(commandArray) > 6 && strings.ToLower(commandArray[5]) == "with" && strings.ToLower(commandArray[6]) == "columns" {
+						d.TypeOfDemand = DemandCreateTableWithColumns
+						d.Data = []interface{}{commandArray[4], strings.Join(commandArray[7:], " ")}
+					} else {
+						d.TypeOfDemand = DemandCreateTable
+						d.Data = commandArray[4]
+					}
+				case "index":
+					// tell table to index value
+					if len(commandArray) > 4 && strings.ToLower(commandArray[4]) == "value" {
+						d.TypeOfDemand = DemandIndexValues
+					} else {
+						return nil, errors.New("unknown tell table to index command")
+					}
+				case "forget":
+					// tell table to forget index
+					if len(commandArray) > 4 && strings.ToLower(commandArray[4]) == "index" {
+						d.TypeOfDemand = DemandForgetIndex
+					} else {
+						return nil, errors.New("unknown tell table to forget command")
+					}
 				case "fuck":
 					// if next word is off, tell table to fuck off
 					if strings.ToLower(commandArray[4]) == "off" {
@@ -1097,6 +2637,34 @@ func (ctx *Context) parseCommand(cmd string) (*Demand, error) {
 					// first word is name of database
 					d.TypeOfDemand = DemandCreateDatabase
 					d.Data = commandArray[4]
+				case "present":
+					// tell database to present status [name]
+					if len(commandArray) < 5 || strings.ToLower(commandArray[4]) != "status" {
+						return nil, errors.New("unknown tell database to present command")
+					}
+					d.TypeOfDemand = DemandDatabaseStatus
+					d.Data = ""
+					if len(commandArray) > 5 {
+						d.Data = commandArray[5]
+					}
+				case "backup":
+					// tell database to backup [name] to "<dir>"
+					words := commandArray[4:]
+					name := ""
+					if len(words) > 0 && strings.ToLower(words[0]) != "to" {
+						name, words = words[0], words[1:]
+					}
+					if len(words) != 2 || strings.ToLower(words[0]) != "to" {
+						return nil, errors.New("expected tell database to backup [name] to \"<dir>\"")
+					}
+					d.TypeOfDemand = DemandBackup
+					d.Data = []interface{}{name, parseStringLiteral(words[1])}
+				case "rotate":
+					// tell database to rotate key
+					if len(commandArray) < 5 || strings.ToLower(commandArray[4]) != "key" {
+						return nil, errors.New("unknown tell database to rotate command")
+					}
+					d.TypeOfDemand = DemandRotateKey
 				case "fuck":
 					// if next word is off, tell database to fuck off
 					if strings.ToLower(commandArray[4]) == "off" {
@@ -1114,23 +2682,64 @@ func (ctx *Context) parseCommand(cmd string) (*Demand, error) {
 	return d, nil
 }
 
+// parseFilter parses is <value>, between <low> and <high> or starts with <prefix> into the filter and its one or two values
+func parseFilter(words []string) (string, interface{}, interface{}, error) {
+	if len(words) == 2 && strings.ToLower(words[0]) == "is" {
+		a, err := parseLiteral(words[1])
+		return "is", a, nil, err
+	}
+	if len(words) == 4 && strings.ToLower(words[0]) == "between" && strings.ToLower(words[2]) == "and" {
+		a, err := parseLiteral(words[1])
+		if err != nil {
+			return "", nil, nil, err
+		}
+		b, err := parseLiteral(words[3])
+		return "between", a, b, err
+	}
+	if len(words) == 3 && strings.ToLower(words[0]) == "starts" && strings.ToLower(words[1]) == "with" {
+		return "starts with", parseStringLiteral(words[2]), nil, nil
+	}
+	return "", nil, nil, errors.New("expected is <value>, between <low> and <high> or starts with <prefix>")
+}
+
+// wordIndex returns the position of the first word from start on that is word (ignoring case), -1 if there isn't one
+func wordIndex(words []string, start int, word string) int {
+	for i := start; i < len(words); i++ {
+		if strings.ToLower(words[i]) == word {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseOrder reads an optional trailing ascending or descending, returning true for descending
+func parseOrder(words []string) (bool, error) {
+	if len(words) == 0 {
+		return false, nil
+	}
+	if len(words) > 1 {
+		return false, errors.New("unexpected words after order")
+	}
+	switch strings.ToLower(words[0]) {
+	case "ascending", "asc":
+		return false, nil
+	case "descending", "desc":
+		return true, nil
+	}
+	return false, errors.New("order should be ascending or descending")
+}
+
 func handleConnection(conn net.Conn, commandChannel chan *Demand) {
 	defer conn.Close()
 	for {
-		// read until a null byte
-		buf := make([]byte, 4096)
-		for {
-			_, err := conn.Read(buf)
-			if err != nil {
-				return
-			}
-			if buf[0] == 0 {
-				break
+		// read one request, its length comes first so it can hold any byte (see protocol.go)
+		uuid, command, err := readRequest(conn)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("WARNING: error reading from client: ", err)
 			}
+			return
 		}
-		// get uuid (first 36 bytes)
-		uuid := make([]byte, 36)
-		copy(uuid, buf[:36])
 		// if all are 0s, the client wants to create a new context
 		// send that back as a demand
 		allZeros := true
@@ -1151,8 +2760,7 @@ func handleConnection(conn net.Conn, commandChannel chan *Demand) {
 			// await response
 			response := <-returnChannel
 			// send response to client
-			_, err := conn.Write([]byte(response.(string)))
-			if err != nil {
+			if err := writeResponse(conn, response); err != nil {
 				fmt.Println("WARNING: error writing to client: ", err)
 			}
 		} else {
@@ -1175,13 +2783,13 @@ func handleConnection(conn net.Conn, commandChannel chan *Demand) {
 				fmt.Println("WARNING: response from demand channel was not a context pointer")
 				continue
 			} else {
-				// get the command (rest of the bytes)
-				command := make([]byte, len(buf)-36)
-				copy(command, buf[36:])
 				// parse the command
 				newDemand, err := response.(*Context).parseCommand(string(command))
 				if err != nil {
-					fmt.Println("WARNING: error parsing command: ", err)
+					// the client still gets a frame, otherwise it waits for one forever
+					if err := writeResponse(conn, err); err != nil {
+						fmt.Println("WARNING: error writing to client: ", err)
+					}
 					continue
 				}
 				// create a return channel and add it to the demand
@@ -1193,12 +2801,26 @@ func handleConnection(conn net.Conn, commandChannel chan *Demand) {
 				// await response
 				response = <-newDemand.ReturnChannel
 				// send response to client
-				_, err = conn.Write([]byte(response.(string)))
+				if err := writeResponse(conn, response); err != nil {
+					fmt.Println("WARNING: error writing to client: ", err)
+				}
 			}
 		}
 	}
 }
 
+// answerDemand handles a demand and sends back what it returned, or its error so the client can tell it failed
+func answerDemand(demand *Demand) {
+	dataBack, err := demand.AssociatedContext.demandHandler(*demand)
+	if err != nil {
+		fmt.Println("WARNING: error handling demand: ", err)
+		dataBack = err
+	}
+	if demand.ReturnChannel != nil {
+		demand.ReturnChannel <- dataBack
+	}
+}
+
 func handleServer(commandChannel chan *Demand) {
 	// listen on port 8008 for commands
 	listener, err := net.Listen("tcp", ":8008")
@@ -1227,25 +2849,43 @@ func main() {
 			panic(err)
 		}
 		return
-	} else {
-		setup()
-	}
-
-	// load each database file from the database storage path
-	files, err := os.ReadDir(config["database_storage_path"].(string))
-	if err != nil {
-		panic(err)
-	}
-	for _, file := range files {
-		newDatabase, err := loadDB(file.Name())
+	} else if len(os.Args) > 3 && os.Args[1] == "--restore" && os.Args[2] == "--until" {
+		loadConfig()
+		until, err := time.Parse(time.RFC3339Nano, os.Args[3])
 		if err != nil {
-			panic(err)
+			panic("wrong timestamp, use RFC3339 (2006-01-02T15:04:05Z07:00)")
 		}
-		newDatabase.timeSinceLastSave = 0
-		dbs = append(dbs, newDatabase)
+		if err := restoreUntil(until); err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		return
+	} else if len(os.Args) > 2 && os.Args[1] == "--restore" {
+		loadConfig()
+		if err := restoreBackup(os.Args[2]); err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		return
+	} else if len(os.Args) > 2 && (os.Args[1] == "--check" || os.Args[1] == "--repair") {
+		// the config is only needed for the encryption keys
+		if _, err := os.Stat(configPath()); err == nil {
+			loadConfig()
+		}
+		problems, err := runCheck(os.Args[2], os.Args[1] == "--repair")
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(2)
+		}
+		if problems > 0 {
+			os.Exit(1)
+		}
+		return
+	} else {
+		setup()
 	}
 
-	var slowDown int64 = 0
+	lastAutoSave := time.Now()
 
 	sigs := make(chan os.Signal, 10)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -1257,35 +2897,26 @@ func main() {
 		if len(commandChannel) > 0 {
 			newDemand := <-commandChannel
 			if newDemand.AssociatedContext != nil {
-				dataBack, err := newDemand.AssociatedContext.demandHandler(*newDemand)
-				if err != nil {
-					fmt.Println("WARNING: error handling demand: ", err)
-				}
-				if newDemand.ReturnChannel != nil {
-					newDemand.ReturnChannel <- dataBack
-				}
+				answerDemand(newDemand)
 			}
 		}
-		if time.Now().Unix() > slowDown-30 {
-			slowDown = time.Now().Unix()
-			for _, db := range dbs {
-				if time.Now().Unix()-int64(db.timeSinceLastSave) > int64(secondsBetweenAutoSave) {
-					err := db.saveDB(config["database_storage_path"].(string) + db.Name + ".db")
-					if err != nil {
-						fmt.Println("WARNING: error saving database: ", err)
-					}
-				}
-			}
+		if err := wal.tick(); err != nil {
+			fmt.Println("WARNING: error syncing wal: ", err)
+		}
+		if time.Since(lastAutoSave) >= time.Second {
+			lastAutoSave = time.Now()
+			expireEntries()
+			saveDatabases(false)
+			archiveSnapshot()
 		}
 		// check for kill signals
 		if len(sigs) > 0 {
 			sig := <-sigs
 			// save databases
-			for _, db := range dbs {
-				err := db.saveDB(config["database_storage_path"].(string) + db.Name + ".db")
-				if err != nil {
-					fmt.Println("WARNING: error saving database: ", err)
-				}
+			saveDatabases(true)
+			closeEngines()
+			if err := wal.close(); err != nil {
+				fmt.Println("WARNING: error closing wal: ", err)
 			}
 			fmt.Println("Killed by signal: ", sig)
 			os.Exit(0)
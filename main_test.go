@@ -0,0 +1,214 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+test helpers
+a test server keeps everything in a temporary storage path, with a wal that syncs on every record
+and a user root who may do anything in the database app, which has a table t
+*/
+
+var testRoot = User{Name: "root", Password: "pw", Permissions: []Permission{PermRead, PermWrite, PermAdmin}}
+
+// startTestServer starts a test server with nothing on disk yet, the context uses app and t
+func startTestServer(t *testing.T, engine string) *Context {
+	t.Helper()
+	config = map[string]interface{}{"database_storage_path": t.TempDir(), "storage_engine": engine}
+	dbs, deletedDatabases, wal = nil, nil, nil
+	openTestWAL(t)
+	t.Cleanup(stopTestServer)
+	for _, m := range []mutation{
+		{Op: walOpCreateDatabase, Database: "users"},
+		{Op: walOpCreateTable, Database: "users", Table: "app"},
+		{Op: walOpAddEntry, Database: "users", Table: "app", Key: "root", Value: testRoot},
+		{Op: walOpCreateDatabase, Database: "app"},
+		{Op: walOpCreateTable, Database: "app", Table: "t"},
+	} {
+		if err := commitMutation(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return testContext(t, "app", "t")
+}
+
+// crashTestServer throws away everything in memory without saving, then loads the databases and replays the wal like setup does
+func crashTestServer(t *testing.T) *Context {
+	t.Helper()
+	stopTestServer()
+	names, err := databaseNames(config["database_storage_path"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		db, err := openDatabase(name)
+		if err != nil {
+			t.Fatalf("database %s: %v", name, err)
+		}
+		dbs = append(dbs, db)
+	}
+	if err := replayWAL(walPathFromConfig()); err != nil {
+		t.Fatal(err)
+	}
+	openTestWAL(t)
+	return testContext(t, "app", "t")
+}
+
+func openTestWAL(t *testing.T) {
+	t.Helper()
+	var err error
+	if wal, err = openWAL(walPathFromConfig(), walSyncAlways); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stopTestServer() {
+	closeEngines()
+	if wal != nil {
+		wal.close()
+	}
+	dbs, deletedDatabases, wal = nil, nil, nil
+	lastSequence = 0
+}
+
+// testContext is root's context using the given database and table
+func testContext(t *testing.T, database string, table string) *Context {
+	t.Helper()
+	ctx := &Context{DatabaseInUse: -1, TableInUse: -1, UserInUse: "root"}
+	for i := range dbs {
+		if dbs[i].Name == database {
+			ctx.DatabaseInUse = i
+		}
+	}
+	if ctx.DatabaseInUse == -1 {
+		t.Fatalf("database %s not found", database)
+	}
+	for i := range dbs[ctx.DatabaseInUse].Tables {
+		if dbs[ctx.DatabaseInUse].Tables[i].Name == table {
+			ctx.TableInUse = i
+		}
+	}
+	if ctx.TableInUse == -1 {
+		t.Fatalf("table %s not found", table)
+	}
+	if err := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].load(); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// runCommand runs an FSQL command and returns its response the way a client sees it
+func runCommand(t *testing.T, ctx *Context, command string) string {
+	t.Helper()
+	response, err := tryCommand(ctx, command)
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	return response
+}
+
+func tryCommand(ctx *Context, command string) (string, error) {
+	demand, err := ctx.parseCommand(command)
+	if err != nil {
+		return "", err
+	}
+	response, err := ctx.demandHandler(*demand)
+	if err != nil {
+		return "", err
+	}
+	return formatResponse(response), nil
+}
+
+// increments change the entry, a user who may only read can't, whatever the delta is
+func TestIncrementChecksPermissionsFirst(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	runCommand(t, ctx, `tell entry to create n,41`)
+	reader := User{Name: "reader", Password: "pw", Permissions: []Permission{PermRead}}
+	if err := commitMutation(mutation{Op: walOpAddEntry, Database: "users", Table: "app", Key: "reader", Value: reader}); err != nil {
+		t.Fatal(err)
+	}
+	limited := *ctx
+	limited.UserInUse = "reader"
+	for _, delta := range []interface{}{int64(1), "x"} {
+		if _, err := limited.incrementEntry("n", delta); err == nil || err.Error() != "permission denied" {
+			t.Errorf("reader incremented n by %v: %v, want permission denied", delta, err)
+		}
+	}
+	if got := runCommand(t, ctx, `tell entry to increment n`); got != "42" {
+		t.Fatalf("root incremented n to %s, want 42", got)
+	}
+}
+
+// the hash index always points at the first live entry for a key, through deletes, compaction and duplicates
+func TestHashIndex(t *testing.T) {
+	var tb Table
+	for i := int64(0); i < 1000; i++ {
+		tb.addEntry(i, i*2)
+	}
+	for i := int64(0); i < 1000; i++ {
+		if i%3 != 0 {
+			tb.tellEntryToFuckOff(i)
+		}
+	}
+	// more than half the table was deleted, so it has been compacted at least once
+	if len(tb.Data) >= 1000 {
+		t.Fatalf("the table still has %d entries after deleting two thirds of them", len(tb.Data))
+	}
+	for i := int64(0); i < 1000; i++ {
+		pos, ok := tb.lookup(i)
+		if ok != (i%3 == 0) {
+			t.Fatalf("key %d found: %v", i, ok)
+		}
+		if ok && (tb.Data[pos].Key != i || tb.Data[pos].Value != i*2) {
+			t.Fatalf("key %d points at %+v", i, tb.Data[pos])
+		}
+	}
+
+	// tables loaded from files written before keys had to be unique can have a key twice, the first one wins
+	dup := Table{Data: []Entry{{Key: "k", Value: "first"}, {Key: "other", Value: 1.5}, {Key: "k", Value: "second"}}}
+	if entry := dup.getEntry("k"); entry == nil || entry.Value != "first" || dup.duplicates != 1 {
+		t.Fatalf("k is %+v with %d duplicates, want the first one", entry, dup.duplicates)
+	}
+	dup.tellEntryToFuckOff("k")
+	if entry := dup.getEntry("k"); entry == nil || entry.Value != "second" || dup.duplicates != 0 {
+		t.Fatalf("k is %+v after deleting the first one, want the second one", entry)
+	}
+	if entry := dup.getEntry("other"); entry == nil || entry.Value != 1.5 {
+		t.Fatalf("other is %+v", entry)
+	}
+}
+
+// create only makes new keys and replace only changes existing ones, neither leaves a second entry for a key behind
+func TestUniqueKeys(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	runCommand(t, ctx, `tell entry to create k,1`)
+	if _, err := tryCommand(ctx, `tell entry to create k,2`); err == nil || err.Error() != "key exists" {
+		t.Fatalf("creating k again: %v", err)
+	}
+	if _, err := tryCommand(ctx, `tell entry to replace missing,2`); err == nil || err.Error() != "key not found" {
+		t.Fatalf("replacing a key that doesn't exist: %v", err)
+	}
+	runCommand(t, ctx, `tell entry to replace k,3`)
+	for _, data := range [][]interface{}{{"k", int64(4)}, {"new", int64(5)}} {
+		if _, err := ctx.demandHandler(Demand{TypeOfDemand: DemandSetEntry, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+		if len(table.entries()) != 2 || table.duplicates != 0 {
+			t.Fatalf("%s the table has %+v", when, table.entries())
+		}
+		for key, want := range map[string]string{"k": "4", "new": "5", "missing": "null"} {
+			if got := runCommand(t, ctx, `tell entry to present `+key); got != want {
+				t.Errorf("%s %s is %s, want %s", when, key, got, want)
+			}
+		}
+	}
+	check("while running")
+	// the failed create and replace aren't in the wal, replaying it gives the same table
+	ctx = crashTestServer(t)
+	check("after replaying the wal")
+}
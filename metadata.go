@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+entry metadata
+every entry remembers when it was created, when it last changed and which user changed it
+tell entry to present k with metadata returns the entry with its version, created, updated and writer
+tell entry to present where created|updated after|before <time> and tell entry to present where writer is <user> filter on it,
+a time is a ts"..." literal, an RFC 3339 string or a date like "2026-01-01" (UTC)
+like the version it goes with the entry into the wal and the storage engine,
+entries from the old text format have no metadata until they change
+*/
+
+// stampMutation fills in the version and creation time an add or change gives its entry, unless it already has them
+func (tb *Table) stampMutation(m *mutation) {
+	if m.Version == 0 {
+		m.Version = tb.nextVersion(m.Op, m.Key)
+	}
+	if m.Created == 0 {
+		m.Created = m.Time
+		if i, ok := tb.lookup(m.Key); ok && m.Op != walOpAddEntry {
+			m.Created = tb.Data[i].created
+		}
+	}
+}
+
+// setMetadata copies the version, times and writer of an applied add or change to its entry
+func (tb *Table) setMetadata(m mutation) {
+	i, ok := tb.lookup(m.Key)
+	if !ok {
+		return
+	}
+	if m.Version != 0 {
+		tb.Data[i].version = m.Version
+	}
+	tb.Data[i].created = m.Created
+	tb.Data[i].updated = m.Time
+	tb.Data[i].writer = m.User
+}
+
+// metadata returns an entry with everything that's known about it, times and writer are null if they aren't known
+func (entry *Entry) metadata(value interface{}) map[string]interface{} {
+	meta := map[string]interface{}{
+		"key":     entry.Key,
+		"value":   value,
+		"version": int64(entry.version),
+		"created": nil,
+		"updated": nil,
+		"writer":  nil,
+	}
+	if entry.created != 0 {
+		meta["created"] = time.Unix(0, entry.created).UTC()
+	}
+	if entry.updated != 0 {
+		meta["updated"] = time.Unix(0, entry.updated).UTC()
+	}
+	if entry.writer != "" {
+		meta["writer"] = entry.writer
+	}
+	return meta
+}
+
+// parseTime parses a time for a metadata filter: a timestamp literal, an RFC 3339 string or a date
+func parseTime(literal string) (time.Time, error) {
+	value, err := parseLiteral(literal)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, ok := value.(time.Time); ok {
+		return t, nil
+	}
+	s := formatValue(value)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %s, use something like \"2026-01-01\" or \"2026-01-01T12:00:00Z\"", literal)
+}
+
+// keysWithMetadata returns the keys of the entries whose metadata field matches
+// created and updated take after or before and a time.Time, writer takes is and a user name
+func (tb *Table) keysWithMetadata(field string, op string, value interface{}) []interface{} {
+	var keys []interface{}
+	for _, entry := range tb.entries() {
+		var matches bool
+		switch field {
+		case "created", "updated":
+			at := entry.created
+			if field == "updated" {
+				at = entry.updated
+			}
+			t, _ := value.(time.Time)
+			// entries without metadata never match
+			if at == 0 {
+				break
+			}
+			if op == "after" {
+				matches = at > t.UnixNano()
+			} else {
+				matches = at < t.UnixNano()
+			}
+		case "writer":
+			matches = entry.writer != "" && entry.writer == value
+		}
+		if matches {
+			keys = append(keys, entry.Key)
+		}
+	}
+	sortValues(keys)
+	return keys
+}
+
+// getEntryWithMetadata returns an entry and its metadata, nil if there's no entry
+func (ctx *Context) getEntryWithMetadata(key interface{}) (interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	entry := table.getEntry(key)
+	if entry == nil {
+		return nil, nil
+	}
+	// rows in a table with a schema come back by column, like they do without metadata
+	var value interface{} = entry.Value
+	if table.schema != nil {
+		value = table.row(*entry, nil)
+	}
+	return entry.metadata(value), nil
+}
+
+func (ctx *Context) getEntryKeysWithMetadata(field string, op string, value interface{}) ([]interface{}, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return nil, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return nil, errors.New("no table in use")
+	}
+	switch strings.ToLower(field) + " " + strings.ToLower(op) {
+	case "created after", "created before", "updated after", "updated before", "writer is":
+	default:
+		return nil, errors.New("expected where created|updated after|before <time> or where writer is <user>")
+	}
+	return dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].keysWithMetadata(strings.ToLower(field), strings.ToLower(op), value), nil
+}
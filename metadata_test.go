@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetadataFilters(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			ann := User{Name: "ann", Password: "pw", Permissions: []Permission{PermRead, PermWrite}}
+			if err := commitMutation(mutation{Op: walOpAddEntry, Database: "users", Table: "app", Key: "ann", Value: ann}); err != nil {
+				t.Fatal(err)
+			}
+			runCommand(t, ctx, `tell entry to create a,1`)
+			runCommand(t, ctx, `tell entry to create c,3`)
+			time.Sleep(2 * time.Millisecond)
+			between := `"` + time.Now().UTC().Format(time.RFC3339Nano) + `"`
+			time.Sleep(2 * time.Millisecond)
+			runCommand(t, ctx, `tell entry to create b,2`)
+			annCtx := testContext(t, "app", "t")
+			annCtx.UserInUse = "ann"
+			runCommand(t, annCtx, `tell entry to become a,10`)
+
+			check := func(when string) {
+				t.Helper()
+				for command, want := range map[string]string{
+					`tell entry to present where created after ` + between:   `["b"]`,
+					`tell entry to present where created before ` + between:  `["a", "c"]`,
+					`tell entry to present where updated after ` + between:   `["a", "b"]`,
+					`tell entry to present where updated before ` + between:  `["c"]`,
+					`tell entry to present where writer is ann`:              `["a"]`,
+					`tell entry to present where writer is root`:             `["b", "c"]`,
+					`tell entry to present where writer is nobody`:           `[]`,
+					`tell entry to present where created after "2000-01-01"`: `["a", "b", "c"]`,
+				} {
+					if got := runCommand(t, ctx, command); got != want {
+						t.Errorf("%s: %s is %s, want %s", when, command, got, want)
+					}
+				}
+				if _, err := tryCommand(ctx, `tell entry to present where created after nonsense`); err == nil {
+					t.Errorf("%s: a time that isn't one was accepted", when)
+				}
+			}
+			check("while running")
+			saveDatabases(true)
+			ctx = crashTestServer(t)
+			check("after a restart")
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+/*
+ordered key index
+a skip list of every key in a table, so range and prefix queries don't have to look at every entry
+keys of different kinds sort by kind (null, bool, numbers, strings, timestamps), ints and floats sort together,
+an int goes right before a float with the same value, ranges include both
+*/
+
+const skipListMaxLevel = 32
+
+type skipNode struct {
+	key  interface{}
+	next []*skipNode
+}
+
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+	random *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:   &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level:  1,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// compareValues orders two keys, -1 if a comes first, 1 if b comes first, 0 if they're the same
+// an int and a float with the same value are different keys (like they are in the table), the int comes first
+func compareValues(a interface{}, b interface{}) int {
+	if order := compareLoosely(a, b); order != 0 {
+		return order
+	}
+	_, intA := a.(int64)
+	_, intB := b.(int64)
+	if intA == intB {
+		return 0
+	}
+	if intA {
+		return -1
+	}
+	return 1
+}
+
+// compareLoosely is compareValues for filters and ranges, an int and a float with the same value are equal
+func compareLoosely(a interface{}, b interface{}) int {
+	rankA, rankB := sortRank(a), sortRank(b)
+	if rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		b := b.(time.Time)
+		if a.Before(b) {
+			return -1
+		}
+		if a.After(b) {
+			return 1
+		}
+		return 0
+	case int64:
+		if b, ok := b.(int64); ok {
+			if a < b {
+				return -1
+			}
+			if a > b {
+				return 1
+			}
+			return 0
+		}
+	}
+	// at least one of them is a float
+	fa, fb := toFloat(a), toFloat(b)
+	if fa < fb {
+		return -1
+	}
+	if fa > fb {
+		return 1
+	}
+	return 0
+}
+
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int64, float64:
+		return 2
+	case string:
+		return 3
+	case time.Time:
+		return 4
+	}
+	return 5
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func (sl *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.random.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPath fills update with the last node before key on every level
+func (sl *skipList) findPath(key interface{}, update []*skipNode) *skipNode {
+	node := sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && compareValues(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (sl *skipList) insert(key interface{}) {
+	update := make([]*skipNode, skipListMaxLevel)
+	next := sl.findPath(key, update)
+	if next != nil && compareValues(next.key, key) == 0 {
+		return
+	}
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	sl.length++
+}
+
+func (sl *skipList) remove(key interface{}) {
+	update := make([]*skipNode, skipListMaxLevel)
+	node := sl.findPath(key, update)
+	if node == nil || compareValues(node.key, key) != 0 {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// seek returns the first node with a key >= key, an int or float with the same value as key included
+func (sl *skipList) seek(key interface{}) *skipNode {
+	node := sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && compareLoosely(node.next[level].key, key) < 0 {
+			node = node.next[level]
+		}
+	}
+	return node.next[0]
+}
+
+// keyRange returns every key between low and high (both included)
+func (sl *skipList) keyRange(low interface{}, high interface{}, descending bool) []interface{} {
+	var keys []interface{}
+	for node := sl.seek(low); node != nil && compareLoosely(node.key, high) <= 0; node = node.next[0] {
+		keys = append(keys, node.key)
+	}
+	if descending {
+		reverseValues(keys)
+	}
+	return keys
+}
+
+// keysWithPrefix returns every string key starting with prefix
+func (sl *skipList) keysWithPrefix(prefix string, descending bool) []interface{} {
+	var keys []interface{}
+	for node := sl.seek(prefix); node != nil; node = node.next[0] {
+		key, ok := node.key.(string)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+	}
+	if descending {
+		reverseValues(keys)
+	}
+	return keys
+}
+
+func reverseValues(values []interface{}) {
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+// 1 and 1.0 are two keys in the table, so they're two keys in the ordered index too
+func TestIntAndFloatKeysStayApart(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	runCommand(t, ctx, `tell entry to create 1,"int"`)
+	runCommand(t, ctx, `tell entry to create 1.0,"float"`)
+	runCommand(t, ctx, `tell entry to create 2.0,"two"`)
+	if got := runCommand(t, ctx, `tell entry to present where key between 1 and 2`); got != "[1, 1.0, 2.0]" {
+		t.Fatalf("range is %s, want [1, 1.0, 2.0]", got)
+	}
+	runCommand(t, ctx, `tell entry to fuck off 1.0`)
+	if got := runCommand(t, ctx, `tell entry to present where key between 1 and 2`); got != "[1, 2.0]" {
+		t.Fatalf("range is %s after deleting 1.0, want [1, 2.0]", got)
+	}
+	if got := runCommand(t, ctx, `tell entry to present where key between 1.0 and 1.0`); got != "[1]" {
+		t.Fatalf("range from 1.0 to 1.0 is %s, want [1]", got)
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	ordered := []interface{}{nil, false, true, int64(-1), int64(1), 1.0, 1.5, int64(2), "a", "b"}
+	for i := range ordered {
+		for j := range ordered {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := compareValues(ordered[i], ordered[j]); got != want {
+				t.Errorf("compareValues(%#v, %#v) is %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+wire protocol
+every request and response is a frame: length (uint32, big endian) followed by that many bytes, so any byte can be in one
+request: uuid (36 bytes) | command (FSQL), bytes go in a command as b64"..." literals
+response: the result as FSQL literals (see formatLiteral): null, 42, 3.5, true, "text", b64"...", ts"...", json"...",
+lists of results are [a, b, ...] and maps (rows, metadata, status) are {"name": value, ...} in name order,
+durations are strings like "1m30s"
+a demand that fails gets error "<message>" instead, e.g. error "conflict: k is at version 3, not 2",
+so does a command that can't be parsed
+*/
+
+const maxRequestSize = 16 << 20
+
+// readRequest reads one request frame, returning its uuid and command
+func readRequest(r io.Reader) ([]byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 36 {
+		return nil, nil, fmt.Errorf("request of %d bytes is too short for a uuid", length)
+	}
+	if length > maxRequestSize {
+		return nil, nil, fmt.Errorf("request of %d bytes is bigger than %d", length, maxRequestSize)
+	}
+	request := make([]byte, length)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return nil, nil, err
+	}
+	// only a request for a new context (a uuid of all 0s) comes without a command
+	if length == 36 && strings.Trim(string(request), "0") != "" {
+		return nil, nil, errors.New("request has no command")
+	}
+	return request[:36], request[36:], nil
+}
+
+// writeResponse writes one response frame
+func writeResponse(w io.Writer, response interface{}) error {
+	payload := formatResponse(response)
+	_, err := w.Write(append(appendUint32(nil, uint32(len(payload))), payload...))
+	return err
+}
+
+// formatResponse turns whatever a demand returned into FSQL literals
+func formatResponse(response interface{}) string {
+	switch r := response.(type) {
+	case []interface{}:
+		parts := make([]string, len(r))
+		for i, v := range r {
+			parts[i] = formatResponse(v)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case []string:
+		parts := make([]string, len(r))
+		for i, v := range r {
+			parts[i] = formatLiteral(v)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		names := make([]string, 0, len(r))
+		for name := range r {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = formatLiteral(name) + ": " + formatResponse(r[name])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case time.Duration:
+		return formatLiteral(r.String())
+	case int:
+		return formatLiteral(int64(r))
+	case error:
+		return "error " + formatLiteral(r.Error())
+	}
+	return formatLiteral(response)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestRequestFrame(t *testing.T) {
+	uuid := strings.Repeat("1", 36)
+	command := "tell entry to create k,b64\"AAEC\""
+	var frame bytes.Buffer
+	frame.Write(appendUint32(nil, uint32(len(uuid)+len(command))))
+	frame.WriteString(uuid + command)
+	gotUUID, gotCommand, err := readRequest(&frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotUUID) != uuid || string(gotCommand) != command {
+		t.Fatalf("read %q %q, want %q %q", gotUUID, gotCommand, uuid, command)
+	}
+
+	short := bytes.NewReader(appendUint32(nil, 10))
+	if _, _, err := readRequest(short); err == nil {
+		t.Fatal("a request too short for a uuid was read")
+	}
+	huge := bytes.NewReader(appendUint32(nil, maxRequestSize+1))
+	if _, _, err := readRequest(huge); err == nil {
+		t.Fatal("a request over the limit was read")
+	}
+	empty := bytes.NewReader(append(appendUint32(nil, 36), uuid...))
+	if _, _, err := readRequest(empty); err == nil {
+		t.Fatal("a request without a command was read")
+	}
+	// except when it asks for a new context
+	newContext := bytes.NewReader(append(appendUint32(nil, 36), strings.Repeat("0", 36)...))
+	if _, _, err := readRequest(newContext); err != nil {
+		t.Fatalf("a request for a new context wasn't read: %v", err)
+	}
+}
+
+// every command cut short after any word is an error for the client, none of them takes the server down
+func TestTruncatedCommands(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	for _, command := range []string{
+		`use database app`,
+		`use table t`,
+		`tell entry to present where key between 1 and 2 descending`,
+		`tell entry to present where key starts with a`,
+		`tell entry to present where value starts with a`,
+		`tell entry to present where path .a is 1`,
+		`tell entry to present where writer is root`,
+		`tell entry to present version k`,
+		`tell entry to fuck off where key k`,
+		`tell entry to become k,1 if version 1`,
+		`tell entry to expire k in 1h`,
+		`tell entry to increment k by 2`,
+		`tell list to push back l 1`,
+		`tell set to add s "a"`,
+		`tell table to create u with columns id:int,name:string`,
+		`tell table to index value`,
+		`tell database to backup app to "/tmp"`,
+		`tell database to rotate key`,
+		`tell database to fuck off app`,
+	} {
+		words := strings.Fields(command)
+		for n := 0; n < len(words); n++ {
+			truncated := strings.Join(words[:n], " ")
+			if _, err := ctx.parseCommand(truncated); err == nil && n < 3 {
+				t.Errorf("%q parsed", truncated)
+			}
+		}
+	}
+}
+
+func TestResponseFrames(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	_, parseErr := ctx.parseCommand("use spaceship enterprise")
+	if parseErr == nil {
+		t.Fatal("nonsense command parsed")
+	}
+	for response, want := range map[interface{}]string{
+		"text":   `"text"`,
+		true:     `true`,
+		3.0:      `3.0`,
+		parseErr: `error ` + formatLiteral(parseErr.Error()),
+	} {
+		var frame bytes.Buffer
+		if err := writeResponse(&frame, response); err != nil {
+			t.Fatal(err)
+		}
+		length := binary.BigEndian.Uint32(frame.Bytes())
+		if got := frame.String()[4:]; got != want || int(length) != len(want) {
+			t.Errorf("%v went out as %d bytes %s, want %s", response, length, got, want)
+		}
+	}
+}
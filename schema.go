@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+table schemas
+tell table to create people with columns id:int, name:string, age:int gives a table a schema
+the first column is the key, every entry's value is a Record holding the rest of the columns in order
+entries are checked against the schema when they're created or changed, ints are accepted for float columns
+columns other than the key can be null
+a table without a schema is the usual key -> value
+*/
+
+type Column struct {
+	Name string
+	Kind ValueKind
+}
+
+// Record is the value of an entry in a table with a schema, one value per column after the key
+type Record []interface{}
+
+var columnKinds = map[string]ValueKind{
+	"bool":      ValueBool,
+	"int":       ValueInt,
+	"float":     ValueFloat,
+	"string":    ValueString,
+	"bytes":     ValueBytes,
+	"timestamp": ValueTimestamp,
+}
+
+func kindName(kind ValueKind) string {
+	for name, k := range columnKinds {
+		if k == kind {
+			return name
+		}
+	}
+	return fmt.Sprintf("kind %d", kind)
+}
+
+// parseSchema parses "id:int, name:string, ..."
+func parseSchema(declaration string) ([]Column, error) {
+	var schema []Column
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(declaration, ",") {
+		part = strings.TrimSpace(part)
+		name, kindText, ok := splitEscaped(part)
+		name, kindText = strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(kindText))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name:type, got %q", part)
+		}
+		kind, ok := columnKinds[kindText]
+		if !ok {
+			return nil, fmt.Errorf("column %s: unknown type %q", name, kindText)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("column %s is declared twice", name)
+		}
+		seen[name] = true
+		schema = append(schema, Column{Name: name, Kind: kind})
+	}
+	if len(schema) < 2 {
+		return nil, errors.New("a schema needs a key column and at least one more")
+	}
+	if schema[0].Kind == ValueBytes {
+		return nil, errors.New("the first column is the key, it can't be bytes")
+	}
+	return schema, nil
+}
+
+// formatSchema is the opposite of parseSchema
+func formatSchema(schema []Column) string {
+	var parts []string
+	for _, column := range schema {
+		parts = append(parts, column.Name+":"+kindName(column.Kind))
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkColumn makes sure value fits column, returning it converted if it needs to be
+func checkColumn(column Column, value interface{}, key bool) (interface{}, error) {
+	if value == nil {
+		if key {
+			return nil, fmt.Errorf("column %s is the key, it can't be null", column.Name)
+		}
+		return nil, nil
+	}
+	if n, ok := value.(int64); ok && column.Kind == ValueFloat {
+		return float64(n), nil
+	}
+	kind, err := kindOf(value)
+	if err != nil {
+		return nil, err
+	}
+	if kind != column.Kind {
+		return nil, fmt.Errorf("column %s is %s, got %s", column.Name, kindName(column.Kind), formatValue(value))
+	}
+	return value, nil
+}
+
+// checkRow makes sure an entry fits the table's schema, returning the value as it should be stored
+// a table with two columns also takes the one value on its own instead of a record
+func (tb *Table) checkRow(key interface{}, value interface{}) (interface{}, interface{}, error) {
+	if tb.schema == nil {
+		if _, ok := value.(Record); ok {
+			return nil, nil, errors.New("table has no schema, entries are key,value")
+		}
+		return key, value, nil
+	}
+	record, ok := value.(Record)
+	if !ok {
+		record = Record{value}
+	}
+	if len(record) != len(tb.schema)-1 {
+		return nil, nil, fmt.Errorf("table has %d columns (%s), got %d values", len(tb.schema), formatSchema(tb.schema), len(record)+1)
+	}
+	key, err := checkColumn(tb.schema[0], key, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	checked := make(Record, len(record))
+	for i, v := range record {
+		if checked[i], err = checkColumn(tb.schema[i+1], v, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, checked, nil
+}
+
+func (tb *Table) columnIndex(name string) (int, error) {
+	for i, column := range tb.schema {
+		if column.Name == name {
+			return i, nil
+		}
+	}
+	if tb.schema == nil {
+		return 0, errors.New("table has no schema")
+	}
+	return 0, fmt.Errorf("no column %s, the columns are %s", name, formatSchema(tb.schema))
+}
+
+// columnValue returns column i of an entry, 0 is the key
+func (tb *Table) columnValue(entry Entry, i int) interface{} {
+	if i == 0 {
+		return entry.Key
+	}
+	record, ok := entry.Value.(Record)
+	if !ok || i-1 >= len(record) {
+		return nil
+	}
+	return record[i-1]
+}
+
+// row returns the given columns of an entry by name, every column if columns is empty
+func (tb *Table) row(entry Entry, columns []int) map[string]interface{} {
+	row := make(map[string]interface{})
+	if len(columns) == 0 {
+		for i, column := range tb.schema {
+			row[column.Name] = tb.columnValue(entry, i)
+		}
+		return row
+	}
+	for _, i := range columns {
+		row[tb.schema[i].Name] = tb.columnValue(entry, i)
+	}
+	return row
+}
+
+// columnMatches checks a column value against a filter: is <a>, between <a> and <b>, or starts with <a>
+func columnMatches(value interface{}, op string, a interface{}, b interface{}) bool {
+	switch op {
+	case "is":
+		return sortRank(value) == sortRank(a) && compareLoosely(value, a) == 0
+	case "between":
+		return sortRank(value) == sortRank(a) && compareLoosely(value, a) >= 0 && compareLoosely(value, b) <= 0
+	case "starts with":
+		s, ok := value.(string)
+		prefix, _ := a.(string)
+		return ok && strings.HasPrefix(s, prefix)
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSchemaTables(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			for _, declaration := range []string{"id:int", "id:int, id:string", "id:int, name:text", "id:bytes, name:string"} {
+				if _, err := tryCommand(ctx, `tell table to create bad with columns `+declaration); err == nil {
+					t.Errorf("the schema %s was accepted", declaration)
+				}
+			}
+			runCommand(t, ctx, `tell table to create people with columns id:int, name:string, score:float, born:timestamp`)
+			ctx = testContext(t, "app", "people")
+			runCommand(t, ctx, `tell entry to create 1,"ann",3,null`)
+			runCommand(t, ctx, `tell entry to create 2,"bob",2.5,null`)
+			for _, command := range []string{
+				`tell entry to create "x","bob",2.5,null`,
+				`tell entry to create 3,"bob"`,
+				`tell entry to create 3,4,1.0,null`,
+				`tell entry to become 1 with id 5`,
+				`tell entry to become 1 with score "x"`,
+				`tell entry to become 1 with height 2`,
+			} {
+				if _, err := tryCommand(ctx, command); err == nil {
+					t.Errorf("%s doesn't fit the schema but worked", command)
+				}
+			}
+			runCommand(t, ctx, `tell entry to become 1 with name "anna"`)
+
+			check := func(when string) {
+				t.Helper()
+				for command, want := range map[string]string{
+					// an int in a float column is stored as a float
+					`tell entry to present 1`: `{"born": null, "id": 1, "name": "anna", "score": 3.0}`,
+					`tell entry to present name where column score between 2 and 3`: `[{"name": "anna"}, {"name": "bob"}]`,
+					`tell entry to present where column name starts with b`:         `[{"born": null, "id": 2, "name": "bob", "score": 2.5}]`,
+					`tell entry to present id,score where column id is 2`:           `[{"id": 2, "score": 2.5}]`,
+				} {
+					if got := runCommand(t, ctx, command); got != want {
+						t.Errorf("%s: %s is %s, want %s", when, command, got, want)
+					}
+				}
+			}
+			check("while running")
+			saveDatabases(true)
+			crashTestServer(t)
+			ctx = testContext(t, "app", "people")
+			check("after a restart")
+			// the schema is still checked after a restart
+			if _, err := tryCommand(ctx, `tell entry to create 3,4,1.0,null`); err == nil {
+				t.Error("the schema is gone after a restart")
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+per-table segment files
+each database is a directory with a MANIFEST and one <n>.tbl file per table,
+only tables that changed since the last save get a new .tbl file, then a new MANIFEST points at it
+the manifest keeps the usual generations (MANIFEST.1, ...) and .tbl files are only deleted once no kept manifest uses them
+manifest: "FUQLMAN" | version (uint16) | crc32 of the above | section (see format.go) with
+next segment number (uint64) | table count (uint32) | name, file, name, file, ... | applied until (uint64)
+applied until is the sequence number of the newest mutation in the saved tables, wal records up to then are skipped on replay
+a .tbl file is a normal database file (format.go) with a single table in it
+tables are only read from their .tbl file the first time something touches them
+*/
+
+const manifestMagic = "FUQLMAN"
+
+const manifestVersion uint16 = 1
+
+const manifestName = "MANIFEST"
+
+type manifestTable struct {
+	Name string
+	File string
+}
+
+type manifest struct {
+	NextSegment  uint64
+	Tables       []manifestTable
+	AppliedUntil uint64
+}
+
+// databaseDir is the directory a database is stored in, an error if the name would put it anywhere but right in the storage path
+func databaseDir(name string) (string, error) {
+	if err := validateDatabaseName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(config["database_storage_path"].(string), name), nil
+}
+
+// validateDatabaseName makes sure a name can be a database's directory, it can't be empty, . or .. or have a separator in it
+func validateDatabaseName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%q can't be a database name", name)
+	}
+	if strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("database name %q can't have /, \\ or NUL in it", name)
+	}
+	return nil
+}
+
+func encodeManifest(m manifest) []byte {
+	header := appendUint16([]byte(manifestMagic), manifestVersion)
+	out := appendUint32(header, crc32.ChecksumIEEE(header))
+	payload := appendUint64(nil, m.NextSegment)
+	payload = appendUint32(payload, uint32(len(m.Tables)))
+	for _, table := range m.Tables {
+		payload = appendString(payload, table.Name)
+		payload = appendString(payload, table.File)
+	}
+	payload = appendUint64(payload, m.AppliedUntil)
+	return appendSection(out, payload)
+}
+
+func decodeManifest(data []byte) (manifest, error) {
+	var m manifest
+	headerLength := len(manifestMagic) + 2
+	if len(data) < headerLength+4 || !bytes.HasPrefix(data, []byte(manifestMagic)) {
+		return m, errors.New("not a manifest")
+	}
+	if crc32.ChecksumIEEE(data[:headerLength]) != binary.BigEndian.Uint32(data[headerLength:]) {
+		return m, errors.New("manifest header checksum mismatch")
+	}
+	version := binary.BigEndian.Uint16(data[len(manifestMagic):])
+	if version != manifestVersion {
+		return m, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	payload, _, err := readSection(data[headerLength+4:])
+	if err != nil {
+		return m, err
+	}
+	if m.NextSegment, payload, err = readUint64(payload); err != nil {
+		return m, err
+	}
+	count, payload, err := readUint32(payload)
+	if err != nil {
+		return m, err
+	}
+	for i := uint32(0); i < count; i++ {
+		var table manifestTable
+		if table.Name, payload, err = readString(payload); err != nil {
+			return m, err
+		}
+		if table.File, payload, err = readString(payload); err != nil {
+			return m, err
+		}
+		m.Tables = append(m.Tables, table)
+	}
+	if m.AppliedUntil, _, err = readUint64(payload); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+func readManifest(path string) (manifest, error) {
+	data, err := readSealedFile(path)
+	if err != nil {
+		return manifest{}, err
+	}
+	return decodeManifest(data)
+}
+
+// isDatabaseDir is true if dir has a manifest (or an older generation of one)
+func isDatabaseDir(dir string) bool {
+	for generation := 0; generation <= snapshotGenerations(); generation++ {
+		if _, err := os.Stat(generationPath(filepath.Join(dir, manifestName), generation)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDatabaseDir reads the newest intact manifest in dir, the tables themselves are loaded when they're first used
+// older manifests are kept as fallbacks in case a table's newest file turns out to be damaged
+func loadDatabaseDir(dir string) (Database, error) {
+	var db Database
+	var manifests []manifest
+	var firstErr error
+	for generation := 0; generation <= snapshotGenerations(); generation++ {
+		m, err := readManifest(generationPath(filepath.Join(dir, manifestName), generation))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				fmt.Printf("WARNING: could not read generation %d of %s: %v\n", generation, filepath.Join(dir, manifestName), err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	if len(manifests) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no intact manifest in %s", dir)
+		}
+		return db, firstErr
+	}
+	newest := manifests[0]
+	db.nextSegment = newest.NextSegment
+	db.appliedUntil = newest.AppliedUntil
+	for _, mt := range newest.Tables {
+		paths := []string{filepath.Join(dir, mt.File)}
+		for _, older := range manifests[1:] {
+			for _, ot := range older.Tables {
+				if ot.Name == mt.Name && ot.File != mt.File {
+					paths = append(paths, filepath.Join(dir, ot.File))
+				}
+			}
+		}
+		db.Tables = append(db.Tables, Table{Name: mt.Name, file: mt.File, lazy: segmentLoader(mt.Name, paths)})
+	}
+	return db, nil
+}
+
+// segmentLoader loads a table from the first of paths that's intact
+func segmentLoader(name string, paths []string) func() (Table, error) {
+	return func() (Table, error) {
+		for i, path := range paths {
+			loaded, err := loadDB(path)
+			if err == nil && (len(loaded.Tables) != 1 || loaded.Tables[0].Name != name) {
+				err = errors.New("segment file doesn't hold the right table")
+			}
+			if err != nil {
+				fmt.Printf("WARNING: could not load table %s from %s: %v\n", name, path, err)
+				continue
+			}
+			if i > 0 {
+				fmt.Printf("WARNING: table %s loaded from an older segment %s\n", name, path)
+				// the file we have isn't the one the manifest points at, write it out again
+				loaded.Tables[0].dirty = true
+			}
+			return loaded.Tables[0], nil
+		}
+		return Table{}, fmt.Errorf("table %s could not be loaded from any segment", name)
+	}
+}
+
+// saveDB writes every changed table to a new segment file, then a new manifest pointing at them
+func (db *Database) saveDB(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var m manifest
+	var written, uncompressed int64
+	for i := range db.Tables {
+		table := &db.Tables[i]
+		if table.file == "" || table.dirty {
+			file := fmt.Sprintf("%d.tbl", db.nextSegment)
+			db.nextSegment++
+			single := Database{Tables: []Table{*table}}
+			raw := serializeDB(single)
+			compressed, err := compressSnapshot(raw)
+			if err != nil {
+				return err
+			}
+			sealed := sealFile(compressed)
+			err = writeFileAtomic(filepath.Join(dir, file), 0, func(w *bufio.Writer) error {
+				_, err := w.Write(sealed)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			table.file = file
+			written += int64(len(sealed))
+			uncompressed += int64(len(raw))
+		}
+		m.Tables = append(m.Tables, manifestTable{Name: table.Name, File: table.file})
+	}
+	m.NextSegment = db.nextSegment
+	m.AppliedUntil = db.lastMutation
+	err := writeFileAtomic(filepath.Join(dir, manifestName), snapshotGenerations(), func(w *bufio.Writer) error {
+		_, err := w.Write(sealFile(encodeManifest(m)))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i := range db.Tables {
+		db.Tables[i].dirty = false
+	}
+	db.lastSaveBytes, db.lastSaveUncompressedBytes = written, uncompressed
+	return removeUnusedSegments(dir)
+}
+
+// removeUnusedSegments deletes .tbl files that no kept manifest points at
+func removeUnusedSegments(dir string) error {
+	used := make(map[string]bool)
+	for generation := 0; generation <= snapshotGenerations(); generation++ {
+		m, err := readManifest(generationPath(filepath.Join(dir, manifestName), generation))
+		if err != nil {
+			continue
+		}
+		for _, table := range m.Tables {
+			used[table.File] = true
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".tbl") && !used[name] {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
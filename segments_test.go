@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatabaseNamesStayInStoragePath(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	storagePath := config["database_storage_path"].(string)
+	for _, name := range []string{"", ".", "..", "../escaped", "a/b", `a\b`, "a\x00b"} {
+		if err := ctx.addDatabase(name); err == nil {
+			t.Errorf("database %q was created", name)
+		}
+		if _, err := databaseDir(name); err == nil {
+			t.Errorf("database %q has a directory", name)
+		}
+	}
+	if _, err := tryCommand(ctx, `tell database to create ../escaped`); err == nil {
+		t.Error("tell database to create ../escaped worked")
+	}
+	saveDatabases(true)
+	if _, err := os.Stat(filepath.Join(filepath.Dir(storagePath), "escaped")); err == nil {
+		t.Fatal("a database was written outside the storage path")
+	}
+	runCommand(t, ctx, `tell database to create fine`)
+	if dir, err := databaseDir("fine"); err != nil || dir != filepath.Join(storagePath, "fine") {
+		t.Fatalf("fine is in %q (%v)", dir, err)
+	}
+}
+
+// only tables that changed get a new segment, and the manifest remembers how far the saved tables go
+func TestSegmentsRoundTrip(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	runCommand(t, ctx, `tell table to create u`)
+	runCommand(t, ctx, `tell entry to create a,1`)
+	if err := commitMutation(mutation{Op: walOpAddEntry, Database: "app", Table: "u", Key: "b", Value: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	saveDatabases(true)
+	dir, _ := databaseDir("app")
+	before, err := readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCommand(t, ctx, `tell entry to become a,3`)
+	saveDatabases(true)
+	after, err := readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Tables[0].File == after.Tables[0].File || before.Tables[1].File != after.Tables[1].File {
+		t.Fatalf("segments went from %v to %v, want only t to get a new one", before.Tables, after.Tables)
+	}
+	if after.AppliedUntil != findDatabase("app").lastMutation {
+		t.Fatalf("manifest is applied until %d, want %d", after.AppliedUntil, findDatabase("app").lastMutation)
+	}
+
+	ctx = crashTestServer(t)
+	if got := runCommand(t, ctx, `tell entry to present a`); got != "3" {
+		t.Fatalf("a is %s after reloading, want 3", got)
+	}
+	ctx = testContext(t, "app", "u")
+	if got := runCommand(t, ctx, `tell entry to present b`); got != `"two"` {
+		t.Fatalf("b is %s after reloading, want \"two\"", got)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+snapshot files
+a snapshot is written to a temp file, fsynced and renamed over the old one,
+the old ones are kept around as <name>.db.1, <name>.db.2, ... (newest first)
+*/
+
+const defaultSnapshotGenerations = 2
+
+func snapshotGenerations() int {
+	if generations, ok := config["snapshot_generations"].(int64); ok && generations >= 0 {
+		return int(generations)
+	}
+	return defaultSnapshotGenerations
+}
+
+func generationPath(path string, generation int) string {
+	if generation == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, generation)
+}
+
+// writeFileAtomic replaces path with whatever write writes, keeping the previous generations
+// path is never left half-written, if we die halfway through, the old file (or an older generation) is still there
+func writeFileAtomic(path string, generations int, write func(w *bufio.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// shift the old generations down, dropping the oldest
+	if generations > 0 {
+		err = os.Remove(generationPath(path, generations))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for i := generations - 1; i >= 0; i-- {
+			err = os.Rename(generationPath(path, i), generationPath(path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// windows can't fsync a directory, nothing we can do there
+	if err := d.Sync(); err != nil && os.Getenv("OS") != "Windows_NT" {
+		return err
+	}
+	return nil
+}
+
+// databaseNames finds every database in dir, whether its newest generation survived or not
+// that's every directory with a manifest and every old single file <name>.db
+func databaseNames(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() {
+			if !seen[file.Name()] && (isDatabaseDir(filepath.Join(dir, file.Name())) || isBitcaskDir(filepath.Join(dir, file.Name()))) {
+				seen[file.Name()] = true
+				names = append(names, file.Name())
+			}
+			continue
+		}
+		name, ok := legacyDatabaseName(file.Name())
+		if !ok {
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// legacyDatabaseName returns the database an old single file <name>.db (or one of its generations) is for
+func legacyDatabaseName(fileName string) (string, bool) {
+	// strip a generation number
+	if i := strings.LastIndex(fileName, ".db."); i != -1 {
+		if _, err := strconv.Atoi(fileName[i+4:]); err == nil {
+			fileName = fileName[:i+3]
+		}
+	}
+	if !strings.HasSuffix(fileName, ".db") {
+		return "", false
+	}
+	return strings.TrimSuffix(fileName, ".db"), true
+}
+
+// loadNewestGeneration loads the newest generation of path that loads cleanly
+func loadNewestGeneration(path string) (Database, error) {
+	var firstErr error
+	for generation := 0; ; generation++ {
+		genPath := generationPath(path, generation)
+		if _, err := os.Stat(genPath); err != nil {
+			if generation == 0 && errors.Is(err, os.ErrNotExist) {
+				// the newest generation may have been mid-rename, try the older ones
+				continue
+			}
+			break
+		}
+		db, err := loadDB(genPath)
+		if err == nil {
+			if generation > 0 {
+				fmt.Printf("WARNING: %s is damaged or missing, loaded generation %d instead\n", path, generation)
+			}
+			return db, nil
+		}
+		fmt.Printf("WARNING: could not load %s: %v\n", genPath, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no intact generation of %s", path)
+	}
+	return Database{}, firstErr
+}
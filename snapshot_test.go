@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(path string, generations int, text string) error {
+	return writeFileAtomic(path, generations, func(w *bufio.Writer) error {
+		_, err := w.WriteString(text)
+		return err
+	})
+}
+
+func TestWriteFileAtomicKeepsGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.db")
+	for _, text := range []string{"one", "two", "three", "four"} {
+		if err := writeTestFile(path, 2, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for generation, want := range []string{"four", "three", "two"} {
+		if data, err := os.ReadFile(generationPath(path, generation)); err != nil || string(data) != want {
+			t.Errorf("generation %d is %q (%v), want %q", generation, data, err, want)
+		}
+	}
+	if _, err := os.Stat(generationPath(path, 3)); !errors.Is(err, os.ErrNotExist) {
+		t.Error("more than 2 old generations are kept")
+	}
+
+	// a write that fails leaves everything as it was
+	err := writeFileAtomic(path, 2, func(w *bufio.Writer) error {
+		w.WriteString("half")
+		return errors.New("disk full")
+	})
+	if err == nil {
+		t.Fatal("the failed write didn't return its error")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "four" {
+		t.Errorf("after a failed write the file is %q", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("the failed write left its temp file")
+	}
+}
+
+func TestLoadFallsBackToOlderGeneration(t *testing.T) {
+	config = map[string]interface{}{"database_storage_path": t.TempDir()}
+	path := snapshotPath("app")
+	for _, value := range []string{"old", "new"} {
+		var db Database
+		db.addTable("t")
+		db.Tables[0].addEntry("k", value)
+		if err := writeTestFile(path, 2, string(serializeDB(db))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() string {
+		t.Helper()
+		db, err := loadNewestGeneration(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db.Tables[0].getEntry("k").Value.(string)
+	}
+	if got := load(); got != "new" {
+		t.Fatalf("loaded %q, want the newest generation", got)
+	}
+	// damaged
+	if err := os.WriteFile(path, []byte(formatMagic+"garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := load(); got != "old" {
+		t.Fatalf("loaded %q from a damaged newest generation, want the one before", got)
+	}
+	// gone, like a crash between shifting the generations and renaming the new one in
+	os.Remove(path)
+	if got := load(); got != "old" {
+		t.Fatalf("loaded %q without a newest generation, want the one before", got)
+	}
+	if names, _ := databaseNames(config["database_storage_path"].(string)); len(names) != 1 || names[0] != "app" {
+		t.Fatalf("databases %v, want app to be found by its older generation", names)
+	}
+}
+
+// a table whose newest segment is damaged is loaded from the segment an older manifest points at
+func TestSegmentFallsBackToOlderManifest(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	runCommand(t, ctx, `tell entry to create k,1`)
+	saveDatabases(true)
+	runCommand(t, ctx, `tell entry to become k,2`)
+	saveDatabases(true)
+	dir, _ := databaseDir("app")
+	m, err := readManifest(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range m.Tables {
+		if table.Name == "t" {
+			if err := os.WriteFile(filepath.Join(dir, table.File), []byte("damaged"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ctx = crashTestServer(t)
+	if got := runCommand(t, ctx, `tell entry to present k`); got != "1" {
+		t.Fatalf("k is %s, want 1 from the older segment", got)
+	}
+	if !dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].dirty {
+		t.Fatal("the table loaded from an older segment isn't written out again on the next save")
+	}
+}
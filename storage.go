@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+storage engines
+every database has an engine that decides how it ends up on disk,
+the engine is picked with storage_engine = "<name>" in the config, storage_engine.<database> = "<name>" overrides it for one database
+a database that's already on disk keeps whatever engine wrote it
+file: a directory of per-table segment files (segments.go), also reads the old single file format
+bitcask: an append-only log of changes (bitcask.go)
+memory: nothing is written, the database is gone after a restart
+*/
+
+const defaultStorageEngine = "file"
+
+type StorageEngine interface {
+	// open gets the engine ready to use the database's directory, nothing is read yet
+	open(dir string) error
+	// load reads the database from disk, tables may be left to load when they're first used
+	load() (Database, error)
+	// apply is called with every mutation to the database before it changes the in-memory copy
+	apply(m mutation) error
+	// snapshot writes out whatever apply didn't already put on disk
+	snapshot(db *Database) error
+	close() error
+}
+
+// more engines go here
+var storageEngines = map[string]func() StorageEngine{
+	"file":    func() StorageEngine { return &fileEngine{} },
+	"bitcask": func() StorageEngine { return &bitcaskEngine{} },
+	"memory":  func() StorageEngine { return &memoryEngine{} },
+}
+
+func newStorageEngine(name string) (StorageEngine, error) {
+	newEngine, ok := storageEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage engine %s", name)
+	}
+	return newEngine(), nil
+}
+
+func storageEngineNames() []string {
+	var names []string
+	for name := range storageEngines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configuredEngine is the engine the config picks for a database
+func configuredEngine(name string) string {
+	if engine, ok := config["storage_engine."+name].(string); ok {
+		return engine
+	}
+	if engine, ok := config["storage_engine"].(string); ok {
+		return engine
+	}
+	return defaultStorageEngine
+}
+
+// detectEngine returns the engine that wrote the database in dir, or "" if there isn't one
+func detectEngine(dir string) string {
+	if isBitcaskDir(dir) {
+		return "bitcask"
+	}
+	if isDatabaseDir(dir) {
+		return "file"
+	}
+	// the old single file next to the directory
+	if _, err := os.Stat(dir + ".db"); err == nil {
+		return "file"
+	}
+	return ""
+}
+
+// openDatabase opens and loads a database with the engine that wrote it, or the configured one if it's new
+func openDatabase(name string) (Database, error) {
+	dir, err := databaseDir(name)
+	if err != nil {
+		return Database{}, err
+	}
+	engineName := configuredEngine(name)
+	if onDisk := detectEngine(dir); onDisk != "" && onDisk != engineName {
+		fmt.Printf("WARNING: database %s is stored with the %s engine, not %s, keeping %s\n", name, onDisk, engineName, onDisk)
+		engineName = onDisk
+	}
+	engine, err := newStorageEngine(engineName)
+	if err != nil {
+		return Database{}, err
+	}
+	if err := engine.open(dir); err != nil {
+		return Database{}, err
+	}
+	db, err := engine.load()
+	if err != nil {
+		engine.close()
+		return Database{}, err
+	}
+	db.Name = name
+	db.engine = engine
+	db.lastMutation = db.appliedUntil
+	return db, nil
+}
+
+// closeEngines closes every database's engine, call this on shutdown
+func closeEngines() {
+	for i := range dbs {
+		if dbs[i].engine == nil {
+			continue
+		}
+		if err := dbs[i].engine.close(); err != nil {
+			fmt.Println("WARNING: error closing database ", dbs[i].Name, ": ", err)
+		}
+		dbs[i].engine = nil
+	}
+}
+
+// fileEngine keeps a directory of segment files, written on snapshot
+type fileEngine struct {
+	dir string
+	// legacy is true if the database was loaded from a single <name>.db file, it's removed after the next snapshot
+	legacy bool
+}
+
+func (e *fileEngine) open(dir string) error {
+	e.dir = dir
+	return nil
+}
+
+func (e *fileEngine) load() (Database, error) {
+	if isDatabaseDir(e.dir) {
+		db, err := loadDB(e.dir)
+		if info, statErr := os.Stat(filepath.Join(e.dir, manifestName)); statErr == nil {
+			db.lastSave = info.ModTime()
+		}
+		return db, err
+	}
+	legacyPath := e.dir + ".db"
+	if _, err := os.Stat(legacyPath); errors.Is(err, os.ErrNotExist) {
+		return Database{}, nil
+	}
+	db, err := loadNewestGeneration(legacyPath)
+	e.legacy = true
+	db.markDirty()
+	return db, err
+}
+
+func (e *fileEngine) apply(m mutation) error {
+	return nil
+}
+
+func (e *fileEngine) snapshot(db *Database) error {
+	if err := db.saveDB(e.dir); err != nil {
+		return err
+	}
+	if e.legacy {
+		// it's in its directory now, the old single file can go
+		if err := removeSnapshots(db.Name); err != nil {
+			fmt.Println("WARNING: error removing old database file: ", err)
+		}
+		e.legacy = false
+	}
+	return nil
+}
+
+func (e *fileEngine) close() error {
+	return nil
+}
+
+// bitcaskEngine writes every mutation to a bitcask as it happens
+type bitcaskEngine struct {
+	bc *bitcask
+}
+
+func (e *bitcaskEngine) open(dir string) error {
+	bc, err := openBitcask(dir)
+	if err != nil {
+		return err
+	}
+	e.bc = bc
+	return nil
+}
+
+func (e *bitcaskEngine) load() (Database, error) {
+	return Database{Tables: e.bc.tables(), appliedUntil: e.bc.lastSequence}, nil
+}
+
+func (e *bitcaskEngine) apply(m mutation) error {
+	return e.bc.append(m)
+}
+
+// snapshot only has to sync, everything was written by apply
+func (e *bitcaskEngine) snapshot(db *Database) error {
+	return e.bc.sync()
+}
+
+func (e *bitcaskEngine) close() error {
+	return e.bc.close()
+}
+
+// memoryEngine never writes anything
+type memoryEngine struct{}
+
+func (e *memoryEngine) open(dir string) error {
+	return nil
+}
+
+func (e *memoryEngine) load() (Database, error) {
+	return Database{lastSave: time.Now()}, nil
+}
+
+func (e *memoryEngine) apply(m mutation) error {
+	return nil
+}
+
+func (e *memoryEngine) snapshot(db *Database) error {
+	return nil
+}
+
+func (e *memoryEngine) close() error {
+	return nil
+}
+
+// validateEngineConfig makes sure every storage_engine key in the config names an engine that exists
+func validateEngineConfig() error {
+	for key, value := range config {
+		if key != "storage_engine" && !strings.HasPrefix(key, "storage_engine.") {
+			continue
+		}
+		name, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", key)
+		}
+		if _, ok := storageEngines[name]; !ok {
+			return fmt.Errorf("%s: unknown storage engine %s, use one of %s", key, name, strings.Join(storageEngineNames(), ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// every engine gives the same answers while running, only what's left after a restart differs
+func TestStorageEngines(t *testing.T) {
+	for _, engine := range storageEngineNames() {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			for _, command := range []string{
+				`tell entry to create a,1`,
+				`tell entry to create b,"two"`,
+				`tell entry to create c,3.5`,
+				`tell entry to become a,10`,
+				`tell entry to fuck off b`,
+			} {
+				runCommand(t, ctx, command)
+			}
+			check := func(when string) {
+				t.Helper()
+				for command, want := range map[string]string{
+					`tell entry to present a`:                         `10`,
+					`tell entry to present c`:                         `3.5`,
+					`tell entry to present where key between a and c`: `["a", "c"]`,
+				} {
+					if got := runCommand(t, ctx, command); got != want {
+						t.Errorf("%s: %s is %s, want %s", when, command, got, want)
+					}
+				}
+			}
+			check("while running")
+			saveDatabases(true)
+
+			// after a save the wal is empty, everything has to come from the engine
+			dir, _ := databaseDir("app")
+			if got := detectEngine(dir); engine != "memory" && got != engine {
+				t.Fatalf("the database on disk is from the %q engine", got)
+			}
+			if engine == "memory" {
+				if got := detectEngine(dir); got != "" {
+					t.Fatalf("the memory engine wrote a %s database", got)
+				}
+				stopTestServer()
+				names, _ := databaseNames(config["database_storage_path"].(string))
+				for _, name := range names {
+					if name == "app" {
+						t.Fatal("the memory engine's database is still there after a restart")
+					}
+				}
+				return
+			}
+			ctx = crashTestServer(t)
+			check("after a restart")
+		})
+	}
+}
+
+// a database keeps the engine that wrote it, the config only picks one for new databases
+func TestStorageEngineStaysWithTheDatabase(t *testing.T) {
+	startTestServer(t, "bitcask")
+	saveDatabases(true)
+	config["storage_engine"] = "file"
+	config["storage_engine.other"] = "memory"
+	if got := configuredEngine("app"); got != "file" {
+		t.Fatalf("app is configured with %s", got)
+	}
+	if got := configuredEngine("other"); got != "memory" {
+		t.Fatalf("other is configured with %s, want the per-database setting", got)
+	}
+	crashTestServer(t)
+	for _, db := range dbs {
+		if _, ok := db.engine.(*bitcaskEngine); !ok {
+			t.Errorf("database %s is opened with %T, want the bitcask engine that wrote it", db.Name, db.engine)
+		}
+	}
+	if got := detectEngine(filepath.Join(config["database_storage_path"].(string), "app")); got != "bitcask" {
+		t.Fatalf("app is stored with %q after a restart", got)
+	}
+
+	config["storage_engine"] = "nonsense"
+	if err := validateEngineConfig(); err == nil {
+		t.Fatal("an unknown engine in the config isn't an error")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+/*
+secondary index on values
+maps each value to the keys that have it, plus a skip list of the values so prefix lookups don't scan the table
+bytes and users can't be indexed (they aren't comparable), lookups for those always scan
+*/
+
+type valueIndex struct {
+	keys   map[interface{}]map[interface{}]bool
+	values *skipList
+}
+
+func newValueIndex() *valueIndex {
+	return &valueIndex{keys: make(map[interface{}]map[interface{}]bool), values: newSkipList()}
+}
+
+func indexable(value interface{}) bool {
+	return validateKey(value) == nil
+}
+
+func (vi *valueIndex) add(key interface{}, value interface{}) {
+	if !indexable(value) {
+		return
+	}
+	keys, ok := vi.keys[value]
+	if !ok {
+		keys = make(map[interface{}]bool)
+		vi.keys[value] = keys
+		vi.values.insert(value)
+	}
+	keys[key] = true
+}
+
+func (vi *valueIndex) remove(key interface{}, value interface{}) {
+	if !indexable(value) {
+		return
+	}
+	keys, ok := vi.keys[value]
+	if !ok {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(vi.keys, value)
+		vi.values.remove(value)
+	}
+}
+
+// exact returns the keys whose value is value, sorted
+func (vi *valueIndex) exact(value interface{}) []interface{} {
+	if !indexable(value) {
+		return nil
+	}
+	return sortedKeys(vi.keys[value])
+}
+
+// prefix returns the keys whose value is a string starting with prefix, sorted
+func (vi *valueIndex) prefix(prefix string) []interface{} {
+	var keys []interface{}
+	for node := vi.values.seek(prefix); node != nil; node = node.next[0] {
+		value, ok := node.key.(string)
+		if !ok || !strings.HasPrefix(value, prefix) {
+			break
+		}
+		for key := range vi.keys[value] {
+			keys = append(keys, key)
+		}
+	}
+	sortValues(keys)
+	return keys
+}
+
+func sortedKeys(set map[interface{}]bool) []interface{} {
+	keys := make([]interface{}, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sortValues(keys)
+	return keys
+}
+
+func sortValues(values []interface{}) {
+	sort.Slice(values, func(i, j int) bool {
+		return compareValues(values[i], values[j]) < 0
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+// lookups by value give the same answer with or without the index, the index is only faster
+func TestValueIndexLookups(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	for _, command := range []string{
+		`tell entry to create a,"apple"`,
+		`tell entry to create b,"apricot"`,
+		`tell entry to create c,"banana"`,
+		`tell entry to create d,1`,
+		`tell entry to create e,1`,
+		`tell entry to create f,"apple"`,
+	} {
+		runCommand(t, ctx, command)
+	}
+	check := func(when string) {
+		t.Helper()
+		for command, want := range map[string]string{
+			`tell entry to present where value is "apple"`:     `["a", "f"]`,
+			`tell entry to present where value is 1`:           `["d", "e"]`,
+			`tell entry to present where value is "cherry"`:    `[]`,
+			`tell entry to present where value starts with ap`: `["a", "b", "f"]`,
+			`tell entry to present where value starts with b`:  `["c"]`,
+		} {
+			if got := runCommand(t, ctx, command); got != want {
+				t.Errorf("%s: %s is %s, want %s", when, command, got, want)
+			}
+		}
+	}
+	check("without the index")
+	runCommand(t, ctx, `tell table to index value`)
+	if dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].values == nil {
+		t.Fatal("the table has no value index")
+	}
+	check("with the index")
+
+	// the index follows changes
+	runCommand(t, ctx, `tell entry to become f,"banana"`)
+	runCommand(t, ctx, `tell entry to fuck off b`)
+	runCommand(t, ctx, `tell entry to create g,"apple pie"`)
+	want := map[string]string{
+		`tell entry to present where value is "apple"`:     `["a"]`,
+		`tell entry to present where value is "banana"`:    `["c", "f"]`,
+		`tell entry to present where value starts with ap`: `["a", "g"]`,
+	}
+	for command, value := range want {
+		if got := runCommand(t, ctx, command); got != value {
+			t.Errorf("after changes %s is %s, want %s", command, got, value)
+		}
+	}
+
+	// and is still there after a restart
+	saveDatabases(true)
+	ctx = crashTestServer(t)
+	if dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].values == nil {
+		t.Fatal("the value index is gone after a restart")
+	}
+	for command, value := range want {
+		if got := runCommand(t, ctx, command); got != value {
+			t.Errorf("after a restart %s is %s, want %s", command, got, value)
+		}
+	}
+	runCommand(t, ctx, `tell table to forget index`)
+	if dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].values != nil {
+		t.Fatal("the table kept its value index")
+	}
+}
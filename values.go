@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+values
+keys and values are always one of these go types in memory:
+nil, bool, int64, float64, string, []byte, time.Time (and User in the users database)
+entries in a table with a schema have a Record of those as their value (see schema.go)
+a value can also be a List or a Set of them (see collections.go), or a json Document (see document.go)
+on disk they're a kind byte followed by the value, strings and bytes are length-prefixed so they can hold anything
+in FSQL bytes are b64"..." literals (see parseLiteral and formatLiteral)
+*/
+
+// value kinds
+const (
+	ValueNull = iota
+	ValueBool
+	ValueInt
+	ValueFloat
+	ValueString
+	ValueBytes
+	ValueTimestamp
+	ValueUser
+	ValueRecord
+	ValueList
+	ValueSet
+	ValueDocument
+)
+
+type ValueKind byte
+
+func kindOf(v interface{}) (ValueKind, error) {
+	switch v.(type) {
+	case nil:
+		return ValueNull, nil
+	case bool:
+		return ValueBool, nil
+	case int64:
+		return ValueInt, nil
+	case float64:
+		return ValueFloat, nil
+	case string:
+		return ValueString, nil
+	case []byte:
+		return ValueBytes, nil
+	case time.Time:
+		return ValueTimestamp, nil
+	case User:
+		return ValueUser, nil
+	case Record:
+		return ValueRecord, nil
+	case List:
+		return ValueList, nil
+	case Set:
+		return ValueSet, nil
+	case Document:
+		return ValueDocument, nil
+	}
+	return 0, fmt.Errorf("unsupported value type %T", v)
+}
+
+// normalizeValue turns whatever go type we were handed into one of the value types
+func normalizeValue(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int8:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case uint8:
+		return int64(n), nil
+	case uint16:
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	case float32:
+		return float64(n), nil
+	case time.Time:
+		// drop the monotonic clock reading so values compare the same before and after a restart
+		return n.Round(0), nil
+	case Record:
+		record := make(Record, len(n))
+		for i, v := range n {
+			var err error
+			if record[i], err = normalizeValue(v); err != nil {
+				return nil, err
+			}
+			if _, nested := record[i].(Record); nested {
+				return nil, errors.New("records can't hold records")
+			}
+		}
+		return record, nil
+	case List:
+		list := make(List, len(n))
+		for i, v := range n {
+			var err error
+			if list[i], err = normalizeValue(v); err != nil {
+				return nil, err
+			}
+			if err := checkElement(list[i], false); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case Set:
+		set := make(Set, len(n))
+		for v := range n {
+			member, err := normalizeValue(v)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkElement(member, true); err != nil {
+				return nil, err
+			}
+			set[member] = true
+		}
+		return set, nil
+	}
+	if _, err := kindOf(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// validateKey makes sure key can be used as a key (it has to be comparable)
+func validateKey(key interface{}) error {
+	kind, err := kindOf(key)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case ValueBytes, ValueUser, ValueRecord, ValueList, ValueSet, ValueDocument:
+		return errors.New("bytes, users, records, lists, sets and documents can't be used as keys")
+	}
+	return nil
+}
+
+func appendValue(buf []byte, v interface{}) []byte {
+	kind, err := kindOf(v)
+	if err != nil {
+		// shouldn't happen, everything is normalized before it goes into a table
+		return appendValue(buf, fmt.Sprintf("%v", v))
+	}
+	buf = append(buf, byte(kind))
+	switch kind {
+	case ValueBool:
+		if v.(bool) {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case ValueInt:
+		return appendUint64(buf, uint64(v.(int64)))
+	case ValueFloat:
+		return appendUint64(buf, math.Float64bits(v.(float64)))
+	case ValueString:
+		return appendString(buf, v.(string))
+	case ValueBytes:
+		return appendString(buf, string(v.([]byte)))
+	case ValueTimestamp:
+		return appendUint64(buf, uint64(v.(time.Time).UnixNano()))
+	case ValueUser:
+		user := v.(User)
+		buf = appendString(buf, user.Name)
+		buf = appendString(buf, user.Password)
+		buf = appendString(buf, user.FakePassword)
+		buf = appendString(buf, user.SocialSecurityNumber)
+		buf = appendUint32(buf, uint32(len(user.Permissions)))
+		for _, permission := range user.Permissions {
+			buf = appendUint32(buf, uint32(permission))
+		}
+	case ValueRecord:
+		record := v.(Record)
+		buf = appendUint32(buf, uint32(len(record)))
+		for _, column := range record {
+			buf = appendValue(buf, column)
+		}
+	case ValueList:
+		list := v.(List)
+		buf = appendUint32(buf, uint32(len(list)))
+		for _, element := range list {
+			buf = appendValue(buf, element)
+		}
+	case ValueSet:
+		// members are written in order so the same set is always the same bytes
+		members := v.(Set).members()
+		buf = appendUint32(buf, uint32(len(members)))
+		for _, member := range members {
+			buf = appendValue(buf, member)
+		}
+	case ValueDocument:
+		buf = appendNode(buf, v.(Document).node)
+	}
+	return buf
+}
+
+func readUint64(buf []byte) (uint64, []byte, error) {
+	if len(buf) < 8 {
+		return 0, nil, errors.New("record is truncated")
+	}
+	return binary.BigEndian.Uint64(buf), buf[8:], nil
+}
+
+func readValue(buf []byte) (interface{}, []byte, error) {
+	if len(buf) < 1 {
+		return nil, nil, errors.New("record is truncated")
+	}
+	kind := ValueKind(buf[0])
+	buf = buf[1:]
+	switch kind {
+	case ValueNull:
+		return nil, buf, nil
+	case ValueBool:
+		if len(buf) < 1 {
+			return nil, nil, errors.New("record is truncated")
+		}
+		return buf[0] != 0, buf[1:], nil
+	case ValueInt:
+		n, rest, err := readUint64(buf)
+		return int64(n), rest, err
+	case ValueFloat:
+		n, rest, err := readUint64(buf)
+		return math.Float64frombits(n), rest, err
+	case ValueString:
+		return readString(buf)
+	case ValueBytes:
+		s, rest, err := readString(buf)
+		return []byte(s), rest, err
+	case ValueTimestamp:
+		n, rest, err := readUint64(buf)
+		return time.Unix(0, int64(n)).UTC(), rest, err
+	case ValueUser:
+		var user User
+		var err error
+		var count uint32
+		if user.Name, buf, err = readString(buf); err != nil {
+			return nil, nil, err
+		}
+		if user.Password, buf, err = readString(buf); err != nil {
+			return nil, nil, err
+		}
+		if user.FakePassword, buf, err = readString(buf); err != nil {
+			return nil, nil, err
+		}
+		if user.SocialSecurityNumber, buf, err = readString(buf); err != nil {
+			return nil, nil, err
+		}
+		if count, buf, err = readUint32(buf); err != nil {
+			return nil, nil, err
+		}
+		for i := uint32(0); i < count; i++ {
+			var permission uint32
+			if permission, buf, err = readUint32(buf); err != nil {
+				return nil, nil, err
+			}
+			user.Permissions = append(user.Permissions, Permission(permission))
+		}
+		return user, buf, nil
+	case ValueRecord:
+		count, rest, err := readUint32(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		// every column takes at least its kind byte
+		if int(count) > len(rest) {
+			return nil, nil, errors.New("record is truncated")
+		}
+		record := make(Record, count)
+		for i := range record {
+			if record[i], rest, err = readValue(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		return record, rest, nil
+	case ValueList, ValueSet:
+		count, rest, err := readUint32(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if int(count) > len(rest) {
+			return nil, nil, errors.New("record is truncated")
+		}
+		elements := make([]interface{}, count)
+		for i := range elements {
+			if elements[i], rest, err = readValue(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		if kind == ValueList {
+			return List(elements), rest, nil
+		}
+		set := make(Set, count)
+		for _, member := range elements {
+			if validateKey(member) != nil {
+				return nil, nil, errors.New("set member is bytes or a collection")
+			}
+			set[member] = true
+		}
+		return set, rest, nil
+	case ValueDocument:
+		node, rest, err := readNode(buf)
+		return Document{node: node}, rest, err
+	}
+	return nil, nil, fmt.Errorf("unknown value kind %d", kind)
+}
+
+// formatValue is how values are shown to clients and matched against regexes
+func formatValue(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return n
+	case time.Time:
+		return n.Format(time.RFC3339Nano)
+	case Record:
+		columns := make([]string, len(n))
+		for i, v := range n {
+			columns[i] = formatValue(v)
+		}
+		return strings.Join(columns, ",")
+	case List:
+		return "[" + formatValue(Record(n)) + "]"
+	case Set:
+		return "{" + formatValue(Record(n.members())) + "}"
+	case Document:
+		return n.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// addNumbers adds two numeric values, two ints make an int (or an overflow error), anything with a float makes a float
+func addNumbers(a interface{}, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			sum := x + y
+			if (y > 0 && sum < x) || (y < 0 && sum > x) {
+				return nil, errors.New("integer overflow")
+			}
+			return sum, nil
+		case float64:
+			return float64(x) + y, nil
+		}
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x + float64(y), nil
+		case float64:
+			return x + y, nil
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a number", formatValue(a))
+	}
+	return nil, fmt.Errorf("%s is not a number", formatValue(b))
+}
+
+// negateNumber returns -n for a numeric value
+func negateNumber(n interface{}) (interface{}, error) {
+	switch x := n.(type) {
+	case int64:
+		if x == math.MinInt64 {
+			return nil, errors.New("integer overflow")
+		}
+		return -x, nil
+	case float64:
+		return -x, nil
+	}
+	return nil, fmt.Errorf("%s is not a number", formatValue(n))
+}
+
+// parseLiteral turns an FSQL literal into a value
+// 42, 3.5, true, null, "text", ts"2006-01-02T15:04:05Z", json"{\"a\": 1}", b64"aGk=" (bytes), anything else is a bare string
+func parseLiteral(literal string) (interface{}, error) {
+	switch strings.ToLower(literal) {
+	case "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if strings.HasPrefix(literal, "\"") {
+		return unquoteLiteral(literal)
+	}
+	if strings.HasPrefix(literal, "ts\"") {
+		s, err := unquoteLiteral(literal[2:])
+		if err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp literal: %v", err)
+		}
+		return t.UTC(), nil
+	}
+	if strings.HasPrefix(literal, "b64\"") {
+		s, err := unquoteLiteral(literal[3:])
+		if err != nil {
+			return nil, err
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad base64 literal: %v", err)
+		}
+		return b, nil
+	}
+	if strings.HasPrefix(literal, "json\"") {
+		s, err := unquoteLiteral(literal[4:])
+		if err != nil {
+			return nil, err
+		}
+		return parseDocument(s)
+	}
+	if n, err := strconv.ParseInt(literal, 10, 64); err == nil {
+		return n, nil
+	}
+	if strings.ContainsAny(literal, ".eE") {
+		if f, err := strconv.ParseFloat(literal, 64); err == nil {
+			return f, nil
+		}
+	}
+	return literal, nil
+}
+
+// legacyKey is the typed key an untyped key from an old file or wal becomes, it's parsed like a literal in a command,
+// so the text that found the entry before (42, "a b") still finds it
+// anything that can't be a key stays a string
+func legacyKey(key string) interface{} {
+	value, err := parseLiteral(key)
+	if err != nil || validateKey(value) != nil {
+		return key
+	}
+	return value
+}
+
+// formatLiteral is the opposite of parseLiteral, it's how values are sent to clients
+// strings are quoted with everything that isn't printable escaped, so a literal is always plain text
+func formatLiteral(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(n)
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case float64:
+		s := strconv.FormatFloat(n, 'g', -1, 64)
+		// keep it a float when it's parsed again
+		if !strings.ContainsAny(s, ".eEIN") {
+			s += ".0"
+		}
+		return s
+	case string:
+		return strconv.Quote(n)
+	case []byte:
+		return "b64\"" + base64.StdEncoding.EncodeToString(n) + "\""
+	case time.Time:
+		return "ts\"" + n.Format(time.RFC3339Nano) + "\""
+	case Document:
+		return "json" + strconv.Quote(n.String())
+	case Record:
+		columns := make([]string, len(n))
+		for i, v := range n {
+			columns[i] = formatLiteral(v)
+		}
+		return strings.Join(columns, ",")
+	case List:
+		return "[" + formatLiteral(Record(n)) + "]"
+	case Set:
+		return "{" + formatLiteral(Record(n.members())) + "}"
+	case User:
+		return strconv.Quote(n.Name)
+	}
+	return strconv.Quote(formatValue(v))
+}
+
+// parseStringLiteral is for arguments that are always strings (like regexes), quotes are optional
+func parseStringLiteral(literal string) string {
+	if s, err := unquoteLiteral(literal); err == nil && strings.HasPrefix(literal, "\"") {
+		return s
+	}
+	return literal
+}
+
+func unquoteLiteral(literal string) (string, error) {
+	if len(literal) < 2 || !strings.HasSuffix(literal, "\"") {
+		return "", fmt.Errorf("unterminated string literal %s", literal)
+	}
+	s, err := strconv.Unquote(literal)
+	if err != nil {
+		return "", fmt.Errorf("bad string literal %s", literal)
+	}
+	return s, nil
+}
+
+// splitLiterals splits on commas that aren't inside a string literal
+func splitLiterals(s string) []string {
+	var parts []string
+	insideString := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && insideString:
+			i++
+		case s[i] == '"':
+			insideString = !insideString
+		case s[i] == ',' && !insideString:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseKeyValue parses "key,value" into typed values, more than one value ("key,column,column,...") makes a Record
+func parseKeyValue(s string) (interface{}, interface{}, error) {
+	parts := splitLiterals(s)
+	if len(parts) < 2 {
+		return nil, nil, errors.New("expected key,value")
+	}
+	var literals []interface{}
+	for _, part := range parts {
+		literal, err := parseLiteral(strings.TrimSpace(part))
+		if err != nil {
+			return nil, nil, err
+		}
+		literals = append(literals, literal)
+	}
+	if len(literals) == 2 {
+		return literals[0], literals[1], nil
+	}
+	return literals[0], Record(literals[1:]), nil
+}
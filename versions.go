@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+/*
+entry versions and compare-and-set
+every entry has a version, 1 when it's created and one more on every change (including list, set and document changes)
+deleting an entry and creating it again starts over at 1
+tell entry to present version k shows it, 0 means there's no entry
+tell entry to become k,v if version 7 only changes the entry if it's still at version 7 (if version 0 only creates it),
+tell entry to become k,v if value "old" only changes it if its value is still "old"
+when the condition doesn't hold nothing changes and the error starts with "conflict:"
+the version goes with the entry into the wal and the storage engine, so it survives restarts and restores
+*/
+
+// nextVersion is the version an entry gets from an add or a change
+func (tb *Table) nextVersion(op walOp, key interface{}) uint64 {
+	if i, ok := tb.lookup(key); ok && op != walOpAddEntry {
+		return tb.Data[i].version + 1
+	}
+	return 1
+}
+
+// sameValue is true if a and b are the same kind with the same value
+func sameValue(a interface{}, b interface{}) bool {
+	return bytes.Equal(appendValue(nil, a), appendValue(nil, b))
+}
+
+// getVersion returns the version of an entry, 0 if there's no entry
+func (ctx *Context) getVersion(key interface{}) (uint64, error) {
+	// make sure user has read permissions
+	user := ctx.getDB("users").getTable(dbs[ctx.DatabaseInUse].Name).getEntry(ctx.UserInUse)
+	if user == nil {
+		return 0, errors.New("user not found")
+	}
+	foundPermission := false
+	for _, permission := range user.Value.(User).Permissions {
+		if permission == PermRead {
+			foundPermission = true
+			break
+		}
+	}
+	if !foundPermission {
+		return 0, errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return 0, errors.New("no table in use")
+	}
+	entry := dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse].getEntry(key)
+	if entry == nil {
+		return 0, nil
+	}
+	return entry.version, nil
+}
+
+// setEntryIf is setEntry that only goes ahead if the entry is at the expected version (condition "version")
+// or has the expected value (condition "value")
+// demands are handled one at a time, so nothing can change the entry between checking and writing it
+func (ctx *Context) setEntryIf(key interface{}, value interface{}, condition string, expected interface{}) error {
+	// make sure user has read and write permissions, the conditions read the entry and a failed one tells what's in it
+	user := ctx.userEntry()
+	if user == nil {
+		return errors.New("user not found")
+	}
+	foundRead, foundWrite := false, false
+	for _, permission := range user.Value.(User).Permissions {
+		switch permission {
+		case PermRead:
+			foundRead = true
+		case PermWrite:
+			foundWrite = true
+		}
+	}
+	if !foundRead || !foundWrite {
+		return errors.New("permission denied")
+	}
+	if ctx.TableInUse == -1 {
+		return errors.New("no table in use")
+	}
+	table := &dbs[ctx.DatabaseInUse].Tables[ctx.TableInUse]
+	if err := table.load(); err != nil {
+		return err
+	}
+	var err error
+	if key, err = normalizeValue(key); err != nil {
+		return err
+	}
+	if expected, err = normalizeValue(expected); err != nil {
+		return err
+	}
+	entry := table.getEntry(key)
+	switch condition {
+	case "version":
+		want, ok := expected.(int64)
+		if !ok || want < 0 {
+			return fmt.Errorf("a version is a number, got %s", formatValue(expected))
+		}
+		var version uint64
+		if entry != nil {
+			version = entry.version
+		}
+		if version != uint64(want) {
+			return fmt.Errorf("conflict: %s is at version %d, not %d", formatValue(key), version, want)
+		}
+	case "value":
+		if entry == nil {
+			return fmt.Errorf("conflict: %s doesn't exist", formatValue(key))
+		}
+		if !sameValue(entry.Value, expected) {
+			return fmt.Errorf("conflict: %s is %s, not %s", formatValue(key), formatValue(entry.Value), formatValue(expected))
+		}
+	default:
+		return fmt.Errorf("unknown condition %s, use version or value", condition)
+	}
+	// changeEntry and addEntry check permissions
+	if entry != nil {
+		return ctx.changeEntry(key, value)
+	}
+	return ctx.addEntry(key, value)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// answer runs a command through answerDemand and returns the response frame the client would get, without its length
+func answer(t *testing.T, ctx *Context, command string) string {
+	t.Helper()
+	demand, err := ctx.parseCommand(command)
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	demand.AssociatedContext = ctx
+	demand.ReturnChannel = make(chan interface{}, 1)
+	answerDemand(demand)
+	var frame bytes.Buffer
+	if err := writeResponse(&frame, <-demand.ReturnChannel); err != nil {
+		t.Fatal(err)
+	}
+	return frame.String()[4:]
+}
+
+func TestStaleVersionIsRejected(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	runCommand(t, ctx, `tell entry to create k,"a"`)
+	runCommand(t, ctx, `tell entry to become k,"b"`)
+	if got := answer(t, ctx, `tell entry to become k,"c" if version 1`); got != `error "conflict: k is at version 2, not 1"` {
+		t.Fatalf("stale write got %s, want a conflict error", got)
+	}
+	if got := runCommand(t, ctx, `tell entry to present k`); got != `"b"` {
+		t.Fatalf("k is %s after a stale write, want \"b\"", got)
+	}
+	if got := answer(t, ctx, `tell entry to become k,"c" if version 2`); got != "null" {
+		t.Fatalf("current write got %s, want null", got)
+	}
+	if got := runCommand(t, ctx, `tell entry to present version k`); got != "3" {
+		t.Fatalf("k is at version %s, want 3", got)
+	}
+}
+
+// every failed demand reaches the client as an error, not as the null a success gets
+func TestErrorsReachTheClient(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	runCommand(t, ctx, `tell entry to create k,"a"`)
+	for _, command := range []string{
+		`tell entry to create k,"again"`,
+		`tell entry to increment k`,
+		`tell entry to become k,"b" if value "z"`,
+	} {
+		if got := answer(t, ctx, command); !strings.HasPrefix(got, `error "`) {
+			t.Errorf("%s got %s, want an error", command, got)
+		}
+	}
+}
+
+// a conditional write reads the entry, so a user has to be allowed to read and write before the condition is even checked,
+// otherwise the conflict error would tell them the value or version
+func TestConditionalWriteChecksPermissionsFirst(t *testing.T) {
+	ctx := startTestServer(t, "memory")
+	runCommand(t, ctx, `tell entry to create k,"secret"`)
+	for name, permissions := range map[string][]Permission{"writer": {PermWrite}, "reader": {PermRead}} {
+		user := User{Name: name, Password: "pw", Permissions: permissions}
+		if err := commitMutation(mutation{Op: walOpAddEntry, Database: "users", Table: "app", Key: name, Value: user}); err != nil {
+			t.Fatal(err)
+		}
+		limited := *ctx
+		limited.UserInUse = name
+		for _, command := range []string{
+			`tell entry to become k,"mine" if version 7`,
+			`tell entry to become k,"mine" if value "guess"`,
+			`tell entry to become missing,"mine" if version 0`,
+		} {
+			if got := answer(t, &limited, command); got != `error "permission denied"` {
+				t.Errorf("%s: %s got %s, want permission denied", name, command, got)
+			}
+		}
+	}
+	if got := runCommand(t, ctx, `tell entry to present k`); got != `"secret"` {
+		t.Fatalf("k is %s", got)
+	}
+	if got := answer(t, ctx, `tell entry to become k,"new" if value "secret"`); got != "null" {
+		t.Fatalf("root's conditional write got %s", got)
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+write-ahead log
+every mutation is appended here before it touches the in-memory databases,
+so a crash only loses what never made it into the log
+the file is "FUQLWAL" | version (uint16) followed by records of length (uint32) | crc32 | payload
+payload: op (byte) | sequence (uint64) | time (uint64) | database | table | key | value | version (uint64) | created (uint64) | user | expires (uint64)
+version is the version the entry got, created is when it was first added and expires is when an added entry expires,
+each of them 0 if the record doesn't have one
+the sequence number goes up by one with every record, the engines remember the newest one they have on disk,
+replay skips records by it, so a clock that steps back can't make it skip the wrong ones
+a mutation is checked before it's logged, a record that can't be applied never gets into the log
+list, set and document path operations are logged as the add or change of the whole value they result in
+*/
+
+const walMagic = "FUQLWAL"
+
+const walVersion uint16 = 1
+
+// WAL operations
+const (
+	walOpAddEntry = iota + 1
+	walOpChangeEntry
+	walOpDeleteEntry
+	walOpCreateTable
+	walOpDeleteTable
+	walOpCreateDatabase
+	walOpDeleteDatabase
+	walOpIndexValues
+	walOpForgetIndex
+	walOpExpireEntry
+	walOpListPushFront
+	walOpListPushBack
+	walOpListPopFront
+	walOpListPopBack
+	walOpSetAdd
+	walOpSetRemove
+	walOpSetPath
+)
+
+type walOp byte
+
+// fsync policies
+const (
+	walSyncAlways = iota
+	walSyncEverySecond
+	walSyncNever
+)
+
+type walSyncPolicy int
+
+type mutation struct {
+	Op walOp
+	// Sequence is the mutation's place in the log, every committed mutation gets the next one
+	Sequence uint64
+	Time     int64 // unix nanoseconds
+	Database string
+	Table    string
+	Key      interface{}
+	Value    interface{}
+	// Version is the version an add or change gives the entry, 0 until it's applied (see versions.go)
+	Version uint64
+	// Created is when the entry was first added, 0 until it's applied (see metadata.go)
+	Created int64
+	// User is who made the change, empty for changes the server makes on its own
+	User string
+	// Expires is when an added entry expires (unix nanoseconds), 0 if it doesn't, so it can't be added without its deadline
+	Expires int64
+}
+
+type writeAheadLog struct {
+	path     string
+	file     *os.File
+	policy   walSyncPolicy
+	lastSync time.Time
+	unsynced bool
+	// records is how many records are in the log
+	records int
+}
+
+var wal *writeAheadLog
+
+// lastSequence is the sequence number of the newest mutation, in the log or on disk
+var lastSequence uint64
+
+func parseWALSyncPolicy(policy string) (walSyncPolicy, error) {
+	switch policy {
+	case "always":
+		return walSyncAlways, nil
+	case "everysecond", "every second":
+		return walSyncEverySecond, nil
+	case "never":
+		return walSyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown wal fsync policy %q", policy)
+}
+
+// openWAL opens the log for appending
+// whatever is intact in the old log is rewritten first, so a torn record at the end never ends up in the middle of the log
+func openWAL(path string, policy walSyncPolicy) (*writeAheadLog, error) {
+	mutations, err := readWAL(path)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(path, 0, func(w *bufio.Writer) error {
+		if _, err := w.Write(walHeader()); err != nil {
+			return err
+		}
+		for _, m := range mutations {
+			if _, err := w.Write(encodeMutation(m)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{path: path, file: file, policy: policy, lastSync: time.Now(), records: len(mutations)}, nil
+}
+
+// walPathFromConfig is wal_path from the config, or fuqldb.wal in the storage path
+func walPathFromConfig() string {
+	if path, ok := config["wal_path"].(string); ok {
+		return path
+	}
+	return filepath.Join(config["database_storage_path"].(string), "fuqldb.wal")
+}
+
+func walHeader() []byte {
+	return appendUint16([]byte(walMagic), walVersion)
+}
+
+func encodeMutation(m mutation) []byte {
+	var payload []byte
+	payload = append(payload, byte(m.Op))
+	payload = appendUint64(payload, m.Sequence)
+	payload = appendUint64(payload, uint64(m.Time))
+	payload = appendString(payload, m.Database)
+	payload = appendString(payload, m.Table)
+	payload = appendValue(payload, m.Key)
+	payload = appendValue(payload, m.Value)
+	payload = appendUint64(payload, m.Version)
+	payload = appendUint64(payload, uint64(m.Created))
+	payload = appendString(payload, m.User)
+	payload = appendUint64(payload, uint64(m.Expires))
+	payload = sealRecord(payload)
+
+	// record is length, checksum, payload
+	record := appendUint32(nil, uint32(len(payload)))
+	record = appendUint32(record, crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func decodeMutation(payload []byte) (mutation, error) {
+	var m mutation
+	payload, err := unsealRecord(payload)
+	if err != nil {
+		return m, err
+	}
+	if len(payload) < 17 {
+		return m, errors.New("wal record is truncated")
+	}
+	m.Op = walOp(payload[0])
+	m.Sequence = binary.BigEndian.Uint64(payload[1:9])
+	m.Time = int64(binary.BigEndian.Uint64(payload[9:17]))
+	rest := payload[17:]
+	if m.Database, rest, err = readString(rest); err != nil {
+		return m, err
+	}
+	if m.Table, rest, err = readString(rest); err != nil {
+		return m, err
+	}
+	if m.Key, rest, err = readValue(rest); err != nil {
+		return m, err
+	}
+	if m.Value, rest, err = readValue(rest); err != nil {
+		return m, err
+	}
+	var n uint64
+	if m.Version, rest, err = readUint64(rest); err != nil {
+		return m, err
+	}
+	if n, rest, err = readUint64(rest); err != nil {
+		return m, err
+	}
+	m.Created = int64(n)
+	if m.User, rest, err = readString(rest); err != nil {
+		return m, err
+	}
+	if n, _, err = readUint64(rest); err != nil {
+		return m, err
+	}
+	m.Expires = int64(n)
+	return m, nil
+}
+
+func (w *writeAheadLog) append(m mutation) error {
+	if _, err := w.file.Write(encodeMutation(m)); err != nil {
+		return err
+	}
+	w.unsynced = true
+	w.records++
+	if w.policy == walSyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+func (w *writeAheadLog) sync() error {
+	w.lastSync = time.Now()
+	if !w.unsynced {
+		return nil
+	}
+	w.unsynced = false
+	return w.file.Sync()
+}
+
+// tick is called from the main loop and handles the every second fsync policy
+func (w *writeAheadLog) tick() error {
+	if w.policy != walSyncEverySecond || time.Since(w.lastSync) < time.Second {
+		return nil
+	}
+	return w.sync()
+}
+
+// truncate throws away everything in the log, only call this once every database has been saved
+func (w *writeAheadLog) truncate() error {
+	if w.records == 0 {
+		return nil
+	}
+	if archivePath() != "" {
+		if err := w.sync(); err != nil {
+			return err
+		}
+		if err := archiveWAL(w.path); err != nil {
+			return err
+		}
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(walHeader()); err != nil {
+		return err
+	}
+	w.unsynced = false
+	w.records = 0
+	return w.file.Sync()
+}
+
+// dropSaved throws away the records at the start of the log that their databases already have on disk,
+// saves only truncate the whole log once every database is saved, this keeps it from growing until then
+// the rest stays in order, so the next archive still starts where this one ends
+func (w *writeAheadLog) dropSaved() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	mutations, err := readWAL(w.path)
+	if err != nil {
+		return err
+	}
+	saved := 0
+	for saved < len(mutations) && isSaved(mutations[saved]) {
+		saved++
+	}
+	if saved == 0 {
+		return nil
+	}
+	if archivePath() != "" {
+		if err := archiveMutations(mutations[:saved]); err != nil {
+			return err
+		}
+	}
+	err = writeFileAtomic(w.path, 0, func(bw *bufio.Writer) error {
+		if _, err := bw.Write(walHeader()); err != nil {
+			return err
+		}
+		for _, m := range mutations[saved:] {
+			if _, err := bw.Write(encodeMutation(m)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the old file was replaced, keep appending to the new one
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.records = len(mutations) - saved
+	return nil
+}
+
+// isSaved is true if replaying m would do nothing, its database already has it on disk or is gone for good
+func isSaved(m mutation) bool {
+	if db := findDatabase(m.Database); db != nil {
+		return m.Sequence <= db.appliedUntil
+	}
+	for _, deleted := range deletedDatabases {
+		if deleted == m.Database {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *writeAheadLog) close() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// readWAL returns every intact mutation in the log
+// a torn or corrupt record at the end (e.g. from a crash mid-write) ends the log
+func readWAL(path string) ([]mutation, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a crash while the log was being truncated can leave it without its header
+	if len(data) < len(walMagic)+2 {
+		return nil, nil
+	}
+	if !bytes.HasPrefix(data, []byte(walMagic)) {
+		return nil, fmt.Errorf("%s is not a write-ahead log", path)
+	}
+	if version := binary.BigEndian.Uint16(data[len(walMagic):]); version != walVersion {
+		return nil, fmt.Errorf("unsupported wal version %d", version)
+	}
+	data = data[len(walMagic)+2:]
+	var mutations []mutation
+	for len(data) > 0 {
+		if len(data) < 8 || uint32(len(data)-8) < binary.BigEndian.Uint32(data) {
+			fmt.Println("WARNING: wal ends with a torn record, ignoring it")
+			return mutations, nil
+		}
+		payload := data[8 : 8+binary.BigEndian.Uint32(data)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:]) {
+			fmt.Println("WARNING: wal record failed its checksum, ignoring the rest of the log")
+			return mutations, nil
+		}
+		m, err := decodeMutation(payload)
+		if err != nil {
+			return mutations, err
+		}
+		mutations = append(mutations, m)
+		data = data[8+len(payload):]
+	}
+	return mutations, nil
+}
+
+// commitMutation checks the mutation, writes it to the wal (if there is one) and then applies it
+func commitMutation(m mutation) error {
+	m.Time = time.Now().UnixNano()
+	switch m.Op {
+	case walOpAddEntry, walOpChangeEntry, walOpDeleteEntry, walOpExpireEntry,
+		walOpListPushFront, walOpListPushBack, walOpListPopFront, walOpListPopBack, walOpSetAdd, walOpSetRemove, walOpSetPath:
+		var err error
+		if m.Key, err = normalizeValue(m.Key); err != nil {
+			return err
+		}
+		if err = validateKey(m.Key); err != nil {
+			return err
+		}
+		if m.Value, err = normalizeValue(m.Value); err != nil {
+			return err
+		}
+	}
+	// list, set and path operations go into the wal as the whole new value and the version it gives the entry,
+	// so replaying a record that was already applied leaves the entry as it is
+	if isElementOp(m.Op) {
+		db := findDatabase(m.Database)
+		if db == nil {
+			return fmt.Errorf("database %s not found", m.Database)
+		}
+		table := db.getTable(m.Table)
+		if table == nil {
+			return fmt.Errorf("table %s not found in database %s", m.Table, m.Database)
+		}
+		if err := table.load(); err != nil {
+			return err
+		}
+		var err error
+		if m, err = table.resolveElementOp(m); err != nil {
+			return err
+		}
+	}
+	if err := checkMutation(m); err != nil {
+		return err
+	}
+	m.Sequence = lastSequence + 1
+	if wal != nil {
+		if err := wal.append(m); err != nil {
+			return err
+		}
+	}
+	lastSequence = m.Sequence
+	return applyMutation(m)
+}
+
+// checkMutation returns the error applying m would fail with, without changing anything
+func checkMutation(m mutation) error {
+	switch m.Op {
+	case walOpCreateDatabase:
+		return validateDatabaseName(m.Database)
+	case walOpDeleteDatabase:
+		return nil
+	}
+	db := findDatabase(m.Database)
+	if db == nil {
+		return fmt.Errorf("database %s not found", m.Database)
+	}
+	switch m.Op {
+	case walOpCreateTable:
+		_, err := mutationSchema(m)
+		return err
+	case walOpDeleteTable:
+		return nil
+	}
+	table := db.getTable(m.Table)
+	if table == nil {
+		return fmt.Errorf("table %s not found in database %s", m.Table, m.Database)
+	}
+	// never change a table we couldn't load, saving it would throw away whatever is on disk
+	if err := table.load(); err != nil {
+		return err
+	}
+	switch m.Op {
+	case walOpAddEntry:
+		// keys are unique, a second add for a key fails
+		if _, ok := table.lookup(m.Key); ok {
+			return fmt.Errorf("key %s already exists in table %s", formatValue(m.Key), m.Table)
+		}
+	case walOpExpireEntry:
+		if _, ok := table.lookup(m.Key); !ok {
+			return fmt.Errorf("key %s not found in table %s", formatValue(m.Key), m.Table)
+		}
+	case walOpChangeEntry, walOpDeleteEntry, walOpIndexValues, walOpForgetIndex:
+	default:
+		return fmt.Errorf("unknown wal operation %d", m.Op)
+	}
+	return nil
+}
+
+// mutationSchema is the schema a create table mutation gives its table, nil if it doesn't have one
+func mutationSchema(m mutation) ([]Column, error) {
+	declaration, ok := m.Value.(string)
+	if !ok {
+		return nil, nil
+	}
+	schema, err := parseSchema(declaration)
+	if err != nil {
+		return nil, fmt.Errorf("table %s: %v", m.Table, err)
+	}
+	return schema, nil
+}
+
+func findDatabase(name string) *Database {
+	for i := range dbs {
+		if dbs[i].Name == name {
+			return &dbs[i]
+		}
+	}
+	return nil
+}
+
+// applyMutation changes the in-memory databases, no permission checks are done here
+func applyMutation(m mutation) error {
+	return applyMutationWith(m, true)
+}
+
+// applyMutationWith is applyMutation, if engines is false nothing is written to disk and new databases get no engine
+func applyMutationWith(m mutation, engines bool) error {
+	if err := checkMutation(m); err != nil {
+		return err
+	}
+	switch m.Op {
+	case walOpCreateDatabase:
+		if findDatabase(m.Database) != nil {
+			// already loaded from disk, this is a replay
+			return nil
+		}
+		if !engines {
+			dbs = append(dbs, Database{Name: m.Database, pendingChanges: 1, lastMutation: m.Sequence})
+			return nil
+		}
+		// some engines write into the directory right away, so whatever a deleted database left there goes now
+		if err := forgetDeletedDatabase(m.Database); err != nil {
+			return err
+		}
+		dir, err := databaseDir(m.Database)
+		if err != nil {
+			return err
+		}
+		engine, err := newStorageEngine(configuredEngine(m.Database))
+		if err != nil {
+			return err
+		}
+		if err := engine.open(dir); err != nil {
+			return err
+		}
+		dbs = append(dbs, Database{Name: m.Database, pendingChanges: 1, engine: engine, lastMutation: m.Sequence})
+		return nil
+	case walOpDeleteDatabase:
+		for i, db := range dbs {
+			if db.Name == m.Database {
+				dbs = append(dbs[:i], dbs[i+1:]...)
+				if !engines {
+					return nil
+				}
+				if db.engine != nil {
+					if err := db.engine.close(); err != nil {
+						fmt.Println("WARNING: error closing deleted database: ", err)
+					}
+				}
+				deletedDatabases = append(deletedDatabases, m.Database)
+				return nil
+			}
+		}
+		return nil
+	}
+	db := findDatabase(m.Database)
+	if m.Sequence > db.lastMutation {
+		db.lastMutation = m.Sequence
+	}
+	switch m.Op {
+	case walOpCreateTable:
+		schema, _ := mutationSchema(m)
+		if err := db.persist(m); err != nil {
+			return err
+		}
+		db.markDirty()
+		db.addTable(m.Table)
+		db.Tables[len(db.Tables)-1].schema = schema
+		return nil
+	case walOpDeleteTable:
+		if err := db.persist(m); err != nil {
+			return err
+		}
+		db.markDirty()
+		db.tellTableToFuckOff(m.Table)
+		return nil
+	}
+	// checkMutation already found and loaded the table
+	table := db.getTable(m.Table)
+	// the engine stores the version and metadata with the entry, restores already have theirs
+	if m.Op == walOpAddEntry || m.Op == walOpChangeEntry {
+		table.stampMutation(&m)
+	}
+	if err := db.persist(m); err != nil {
+		return err
+	}
+	db.markDirty()
+	table.dirty = true
+	switch m.Op {
+	case walOpAddEntry:
+		table.addEntry(m.Key, m.Value)
+		table.setMetadata(m)
+		if m.Expires != 0 {
+			table.expireEntry(m.Key, time.Unix(0, m.Expires).UTC())
+		}
+	case walOpChangeEntry:
+		table.changeEntry(m.Key, m.Value)
+		table.setMetadata(m)
+	case walOpDeleteEntry:
+		table.tellEntryToFuckOff(m.Key)
+	case walOpIndexValues:
+		table.indexValues()
+	case walOpForgetIndex:
+		table.forgetValueIndex()
+	case walOpExpireEntry:
+		table.expireEntry(m.Key, m.Value)
+	}
+	return nil
+}
+
+// resolveElementOp turns a list, set or document path operation into the add or change of the whole new value,
+// stamped with the version and creation time it gives the entry
+func (tb *Table) resolveElementOp(m mutation) (mutation, error) {
+	var current interface{}
+	i, exists := tb.lookup(m.Key)
+	if exists {
+		current = tb.Data[i].Value
+	}
+	value, err := applyElementOp(m.Op, current, m.Value)
+	if err != nil {
+		return m, fmt.Errorf("key %s in table %s: %v", formatValue(m.Key), m.Table, err)
+	}
+	resolved := mutation{Op: walOpChangeEntry, Time: m.Time, Database: m.Database, Table: m.Table, Key: m.Key, Value: value, User: m.User}
+	if !exists {
+		resolved.Op = walOpAddEntry
+	}
+	tb.stampMutation(&resolved)
+	return resolved, nil
+}
+
+// persist hands a mutation to the database's engine
+func (db *Database) persist(m mutation) error {
+	if db.engine == nil {
+		return nil
+	}
+	return db.engine.apply(m)
+}
+
+// replayWAL applies every mutation in the log on top of the loaded databases
+// new mutations are numbered after the newest one in the log or on disk
+func replayWAL(path string) error {
+	mutations, err := readWAL(path)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if db.appliedUntil > lastSequence {
+			lastSequence = db.appliedUntil
+		}
+	}
+	for _, m := range mutations {
+		if m.Sequence > lastSequence {
+			lastSequence = m.Sequence
+		}
+		// the engine already has everything up to appliedUntil
+		if db := findDatabase(m.Database); db != nil && m.Sequence <= db.appliedUntil {
+			continue
+		}
+		if err := applyMutation(m); err != nil {
+			fmt.Println("WARNING: could not replay wal record: ", err)
+		}
+	}
+	return nil
+}
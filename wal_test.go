@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMutationRoundTrip(t *testing.T) {
+	m := mutation{
+		Op:       walOpAddEntry,
+		Sequence: 12,
+		Time:     time.Now().UnixNano(),
+		Database: "app",
+		Table:    "t",
+		Key:      int64(42),
+		Value:    List{"a", 1.5, true},
+		Version:  3,
+		Created:  7,
+		User:     "root",
+		Expires:  9,
+	}
+	record := encodeMutation(m)
+	decoded, err := decodeMutation(record[8:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Fatalf("decoded %+v, want %+v", decoded, m)
+	}
+}
+
+// a crash can leave half a record at the end of the log, everything before it still replays
+func TestTornRecordEndsTheWAL(t *testing.T) {
+	startTestServer(t, "memory")
+	path := walPathFromConfig()
+	stopTestServer()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole, err := readWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := encodeMutation(whole[len(whole)-1])
+	for name, damaged := range map[string][]byte{
+		"torn":    data[:len(data)-3],
+		"corrupt": append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^0xff),
+	} {
+		if err := os.WriteFile(path, damaged, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mutations, err := readWAL(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(mutations) != len(whole)-1 {
+			t.Fatalf("%s: read %d records, want the %d before the damaged one", name, len(mutations), len(whole)-1)
+		}
+		// opening the log rewrites it without the damaged record, so new records don't end up behind it
+		w, err := openWAL(path, walSyncAlways)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := w.append(whole[len(whole)-1]); err != nil {
+			t.Fatal(err)
+		}
+		w.close()
+		if mutations, _ = readWAL(path); len(mutations) != len(whole) {
+			t.Fatalf("%s: read %d records after appending one, want %d", name, len(mutations), len(whole))
+		}
+		if string(encodeMutation(mutations[len(mutations)-1])) != string(last) {
+			t.Fatalf("%s: the appended record didn't come back", name)
+		}
+	}
+}
+
+// nothing was ever saved, so everything comes back from the wal
+func TestReplayWithoutSave(t *testing.T) {
+	for _, engine := range []string{"file", "bitcask"} {
+		t.Run(engine, func(t *testing.T) {
+			ctx := startTestServer(t, engine)
+			runCommand(t, ctx, `tell entry to create a,1`)
+			runCommand(t, ctx, `tell entry to create b,"two"`)
+			runCommand(t, ctx, `tell entry to become a,3`)
+			runCommand(t, ctx, `tell entry to fuck off b`)
+			runCommand(t, ctx, `tell table to create u`)
+
+			ctx = crashTestServer(t)
+			if got := runCommand(t, ctx, `tell entry to present a`); got != "3" {
+				t.Fatalf("a is %s after the crash, want 3", got)
+			}
+			if got := runCommand(t, ctx, `tell entry to present version a`); got != "2" {
+				t.Fatalf("a is at version %s after the crash, want 2", got)
+			}
+			if got := runCommand(t, ctx, `tell entry to present b`); got != "null" {
+				t.Fatalf("b is %s after the crash, want it deleted", got)
+			}
+			if findDatabase("app").getTable("u") == nil {
+				t.Fatal("table u is gone after the crash")
+			}
+		})
+	}
+}
+
+// a mutation that can't be applied fails before it's logged, so it isn't tried again on every replay
+func TestFailedMutationIsNotLogged(t *testing.T) {
+	startTestServer(t, "memory")
+	before, err := readWAL(walPathFromConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []mutation{
+		{Op: walOpAddEntry, Database: "app", Table: "missing", Key: "k", Value: int64(1)},
+		{Op: walOpAddEntry, Database: "missing", Table: "t", Key: "k", Value: int64(1)},
+		{Op: walOpExpireEntry, Database: "app", Table: "t", Key: "missing", Value: time.Now()},
+		{Op: walOpCreateTable, Database: "app", Table: "u", Value: "id:nothing"},
+		{Op: walOpCreateDatabase, Database: ".."},
+	} {
+		if err := commitMutation(m); err == nil {
+			t.Errorf("%+v was applied", m)
+		}
+	}
+	if err := commitMutation(mutation{Op: walOpAddEntry, Database: "app", Table: "t", Key: "k", Value: int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitMutation(mutation{Op: walOpAddEntry, Database: "app", Table: "t", Key: "k", Value: int64(2)}); err == nil {
+		t.Error("k was added twice")
+	}
+	after, err := readWAL(walPathFromConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatalf("the wal has %d new records, want only the one that was applied", len(after)-len(before))
+	}
+}
+
+// replay skips records by sequence number, not by time, so a clock that stepped back doesn't lose anything
+func TestReplayBySequence(t *testing.T) {
+	ctx := startTestServer(t, "file")
+	runCommand(t, ctx, `tell entry to create a,1`)
+	saveDatabases(true)
+	saved := findDatabase("app").appliedUntil
+	if saved != lastSequence {
+		t.Fatalf("app was saved until %d, want %d", saved, lastSequence)
+	}
+	for _, m := range []mutation{
+		// from before the save, but logged with a time from the future
+		{Op: walOpAddEntry, Sequence: saved, Time: time.Now().Add(time.Hour).UnixNano(), Database: "app", Table: "t", Key: "skipped", Value: int64(1)},
+		// after the save, but the clock went back
+		{Op: walOpAddEntry, Sequence: saved + 1, Time: 1, Database: "app", Table: "t", Key: "replayed", Value: int64(2)},
+	} {
+		if err := wal.append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx = crashTestServer(t)
+	if got := runCommand(t, ctx, `tell entry to present skipped`); got != "null" {
+		t.Errorf("a record the save already had was replayed")
+	}
+	if got := runCommand(t, ctx, `tell entry to present replayed`); got != "2" {
+		t.Errorf("a record from after the save wasn't replayed, it's %s", got)
+	}
+	// and numbering goes on after the newest record
+	if lastSequence != saved+1 {
+		t.Fatalf("the newest sequence number is %d after replaying, want %d", lastSequence, saved+1)
+	}
+	runCommand(t, ctx, `tell entry to create b,3`)
+	if lastSequence != saved+2 {
+		t.Fatalf("the next mutation got sequence number %d, want %d", lastSequence, saved+2)
+	}
+}